@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"cse224/tritonhttp"
 )
@@ -25,6 +30,9 @@ func main() {
 	var port = flag.Int("port", 8080, "the localhost port to listen on")
 	var vh_config_path = flag.String("vh_config", default_vh_config_path, "path to the virtual hosting config file")
 	var docroot_dirs_path = flag.String("docroot", default_docroot, "path to the directory that contains all docroot dirs")
+	var default_host = flag.String("default_host", "", "virtual host for requests naming an unknown host (default: answer them with 421)")
+	var shutdown_timeout = flag.Duration("shutdown_timeout", 10*time.Second, "how long to wait for in-flight requests on SIGINT/SIGTERM")
+	var check = flag.Bool("check", false, "validate the virtual hosting config file and docroots, then exit without serving")
 	flag.Parse() // Parse command line flags, when called, it parses the command-line arguments from os.Args[1:]
 
 	// Log server configs, print out the server configurations
@@ -33,27 +41,71 @@ func main() {
 	log.Printf("  port: %v", *port)
 	log.Printf("  path to virtual hosts config file: %v", *vh_config_path)
 	log.Printf("  path to docroot directories: %v", *docroot_dirs_path)
+	log.Printf("  default host: %q", *default_host)
 	fmt.Println()
 
-	// Parse the virtual hosting config file, and return a map of host name to docRoot path
+	// Parse the virtual hosting config file, and return a map of host name to virtual host
 	// eg. virtual_hosts.yaml:
 	// 	virtual_hosts:
 	//		- hostName: "website1"
 	//		docRoot: "htdocs1"
-	// map[website1:/Users/username/go/src/cse224/tritonhttpd/docroot_dirs/htdocs1]
-	virtualHosts := tritonhttp.ParseVHConfigFile(*vh_config_path, *docroot_dirs_path)
+	// map[website1:&{HostName:website1 DocRoot:/Users/username/go/src/cse224/tritonhttpd/docroot_dirs/htdocs1 ...}]
+	virtualHosts, err := tritonhttp.ParseVHConfigFile(*vh_config_path, *docroot_dirs_path)
+	if err != nil {
+		log.Fatalf("Invalid virtual hosting config:\n%v", err)
+	}
 
-	// Start server
 	// fmt.Sprintf: returns a formatted string, eg. ":9090"
 	addr := fmt.Sprintf(":%v", *port)
-
-	log.Printf("Starting TritonHTTP server")
-	// server is listening on the port, and the virtualHosts map is passed to the server
-	log.Printf("You can browse the website at http://localhost:%v/", *port)
 	s := &tritonhttp.Server{
 		Addr:         addr,
 		VirtualHosts: virtualHosts,
+		DefaultHost:  *default_host,
+		Handler: &tritonhttp.FileHandler{
+			VirtualHosts: virtualHosts,
+		},
+		// Log each request, and keep serving if a handler panics
+		Middleware: []tritonhttp.Middleware{
+			tritonhttp.Logging(nil),
+			tritonhttp.Recover(nil),
+		},
+	}
+
+	// With -check, stop once the config is known to be valid
+	if *check {
+		if err := s.ValidateServerSetup(); err != nil {
+			log.Fatalf("Invalid server setup: %v", err)
+		}
+		log.Printf("Config OK: %d host names", len(virtualHosts))
+		return
 	}
+
+	// Start server
+	log.Printf("Starting TritonHTTP server")
+	// server is listening on the port, and the virtualHosts map is passed to the server
+	log.Printf("You can browse the website at http://localhost:%v/", *port)
+
+	// On SIGINT/SIGTERM, stop accepting connections and let in-flight requests finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		stop() // a second signal kills the process immediately
+		log.Printf("Shutting down, waiting up to %v for open connections", *shutdown_timeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdown_timeout)
+		defer cancel()
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Graceful shutdown did not complete: %v", err)
+			s.Close()
+		}
+	}()
+
 	// ListenAndServe listens on the TCP network address s.Addr and then handles requests on incoming connections
-	log.Fatal(s.ListenAndServe())
+	if err := s.ListenAndServe(); !errors.Is(err, tritonhttp.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-shutdownDone
+	log.Printf("Server stopped")
 }
@@ -3,18 +3,23 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"cse224/tritonhttp"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"mime"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 type ResponseChecker struct {
@@ -48,43 +53,100 @@ func findhtdocs(t *testing.T) string {
 	return htdocsdir
 }
 
-func launchhttpd(t *testing.T) {
+// launchhttpd starts the selected server on a free localhost port and
+// returns that port. The server is shut down when the test finishes.
+func launchhttpd(t *testing.T) string {
 	switch *usehttpd {
 	case "tritonhttp":
-		launchtritonhttpd(t)
+		_, port := launchtritonhttpd(t)
+		return port
 	case "go":
-		launchgohttpd(t)
+		return launchgohttpd(t)
 	default:
 		t.Fatalf("Invalid server type %v (must be 'tritonhttp' or 'go')", *usehttpd)
 	}
+	return ""
 }
 
-func launchgohttpd(t *testing.T) {
+// listenlocal opens a listener on a free localhost port, so the server
+// is accepting connections before the test sends its first request.
+func listenlocal(t *testing.T) (net.Listener, string) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v\n", err.Error())
+	}
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Error parsing listener address: %v\n", err.Error())
+	}
+	return ln, port
+}
+
+func launchgohttpd(t *testing.T) string {
 	htdocs := findhtdocs(t)
+	ln, port := listenlocal(t)
 	s := &http.Server{
-		Addr:    ":8080",
 		Handler: http.FileServer(http.Dir(htdocs)),
 	}
-	go s.ListenAndServe()
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return port
 }
 
-func launchtritonhttpd(t *testing.T) {
+func launchtritonhttpd(t *testing.T) (*tritonhttp.Server, string) {
 	cwd, err := os.Getwd()
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Println(cwd)
 	t.Log(cwd)
-	virtualHosts := tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")
+	virtualHosts := parsevhconfig(t, "../../virtual_hosts.yaml", "../../docroot_dirs")
 	s := &tritonhttp.Server{
-		Addr:         ":8080",
 		VirtualHosts: virtualHosts,
 	}
-	go s.ListenAndServe()
+	return s, servetritonhttpd(t, s)
+}
+
+// parsevhconfig parses a virtual hosting config file, failing the test
+// if it is invalid.
+func parsevhconfig(t *testing.T, config, docroots string) map[string]*tritonhttp.VirtualHost {
+	virtualHosts, err := tritonhttp.ParseVHConfigFile(config, docroots)
+	if err != nil {
+		t.Fatalf("Error parsing %v: %v\n", config, err.Error())
+	}
+	return virtualHosts
+}
+
+// writevhconfig writes files, which map paths to their contents, below a
+// temporary docroot directory, and parses the virtual hosting config in
+// yaml against it, failing the test if it is invalid.
+func writevhconfig(t *testing.T, files map[string]string, yaml string) map[string]*tritonhttp.VirtualHost {
+	docroots := t.TempDir()
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(docroots, name)), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.WriteFile(filepath.Join(docroots, name), []byte(content), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	config := filepath.Join(t.TempDir(), "virtual_hosts.yaml")
+	if err := os.WriteFile(config, []byte(yaml), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	return parsevhconfig(t, config, docroots)
+}
+
+// servetritonhttpd runs s on a free localhost port until the test finishes.
+func servetritonhttpd(t *testing.T, s *tritonhttp.Server) string {
+	ln, port := listenlocal(t)
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return port
 }
 
 func TestGoFetch1(t *testing.T) {
-	launchhttpd(t)
+	port := launchhttpd(t)
 
 	req := fmt.Sprint("GET / HTTP/1.1\r\n"+
 		"Host: website1\r\n",
@@ -92,7 +154,7 @@ func TestGoFetch1(t *testing.T) {
 		"User-Agent: gotest\r\n",
 		"\r\n")
 
-	respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
 	if err != nil {
 		t.Fatalf("Error fetching request: %v\n", err.Error())
 	}
@@ -117,7 +179,7 @@ func TestGoFetch1(t *testing.T) {
 }
 
 func TestGoFetch2(t *testing.T) {
-	launchhttpd(t)
+	port := launchhttpd(t)
 
 	req := fmt.Sprint("GET / HTTP/1.1\r\n",
 		"Host: website1\r\n",
@@ -130,7 +192,7 @@ func TestGoFetch2(t *testing.T) {
 		"\r\n",
 	)
 
-	respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
 	if err != nil {
 		t.Fatalf("Error fetching request: %v\n", err.Error())
 	}
@@ -184,7 +246,7 @@ func TestGoFetch2(t *testing.T) {
 }
 
 func TestGoFetch3(t *testing.T) {
-	launchhttpd(t)
+	port := launchhttpd(t)
 
 	req := fmt.Sprint("foobar\r\n"+
 		"Host: website1\r\n",
@@ -192,7 +254,7 @@ func TestGoFetch3(t *testing.T) {
 		"User-Agent: gotest\r\n",
 		"\r\n")
 
-	respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
 	if err != nil {
 		t.Fatalf("Error fetching request: %v\n", err.Error())
 	}
@@ -212,11 +274,12 @@ func TestGoFetch3(t *testing.T) {
 }
 
 func TestAllFilesInHtdocs(t *testing.T) {
-	launchhttpd(t)
+	port := launchhttpd(t)
 
-	virtualHosts := tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")
+	virtualHosts := parsevhconfig(t, "../../virtual_hosts.yaml", "../../docroot_dirs")
 
-	for hostname, docRoot := range virtualHosts {
+	for hostname, vh := range virtualHosts {
+		docRoot := vh.DocRoot
 
 		err := filepath.Walk(docRoot, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
@@ -242,7 +305,7 @@ func TestAllFilesInHtdocs(t *testing.T) {
 					"User-Agent: gotest\r\n"+
 					"\r\n", testfile)
 
-				respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+				respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
 				if err != nil {
 					t.Fatalf("Error fetching request: %v\n", err.Error())
 				}
@@ -305,3 +368,1031 @@ func TestAllFilesInHtdocs(t *testing.T) {
 	}
 
 }
+
+func TestShutdown(t *testing.T) {
+	virtualHosts := parsevhconfig(t, "../../virtual_hosts.yaml", "../../docroot_dirs")
+	ln, port := listenlocal(t)
+	s := &tritonhttp.Server{
+		VirtualHosts: virtualHosts,
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.Serve(ln) }()
+
+	// Open a keep-alive connection and complete one request on it
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Error connecting: %v\n", err.Error())
+	}
+	defer conn.Close()
+	req := "GET / HTTP/1.1\r\nHost: website1\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatalf("Error writing request: %v\n", err.Error())
+	}
+	connreader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(connreader, nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Expected Shutdown to drain idle connections but got: %v\n", err)
+	}
+
+	if err := <-serveErr; !errors.Is(err, tritonhttp.ErrServerClosed) {
+		t.Fatalf("Expected Serve to return ErrServerClosed but got: %v\n", err)
+	}
+
+	// The idle keep-alive connection should have been closed by the server
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := connreader.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected idle connection to be closed but got: %v\n", err)
+	}
+
+	if _, err := net.Dial("tcp", "localhost:"+port); err == nil {
+		t.Fatal("Expected new connections to be refused after Shutdown")
+	}
+}
+
+// slowserver serves requests with a handler that starts by signalling on
+// started and then waits for release to be closed.
+func slowserver(t *testing.T) (s *tritonhttp.Server, port string, started chan struct{}, release chan struct{}) {
+	started = make(chan struct{}, 1)
+	release = make(chan struct{})
+	s = &tritonhttp.Server{
+		Handler: tritonhttp.HandlerFunc(func(res *tritonhttp.Response, req *tritonhttp.Request) {
+			started <- struct{}{}
+			<-release
+			res.Body = strings.NewReader("done")
+		}),
+	}
+	return s, servetritonhttpd(t, s), started, release
+}
+
+func TestShutdownInFlight(t *testing.T) {
+	s, port, started, release := slowserver(t)
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Error connecting: %v\n", err.Error())
+	}
+	defer conn.Close()
+	// A keep-alive request, still being handled when Shutdown starts
+	if _, err := conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: website1\r\n\r\n")); err != nil {
+		t.Fatalf("Error writing request: %v\n", err.Error())
+	}
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- s.Shutdown(ctx)
+	}()
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Expected Shutdown to wait for the request in flight but it returned: %v\n", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "done" || !resp.Close {
+		t.Fatalf("Expected the response to finish with Connection: close but got %v %q (close %v)\n", resp.StatusCode, body, resp.Close)
+	}
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Fatalf("Expected Shutdown to succeed once the response was written but got: %v\n", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected Shutdown to return once the response was written")
+	}
+
+	// If the request takes longer than the context allows, Shutdown gives up
+	s, port, started, release = slowserver(t)
+	defer close(release)
+	conn2, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Error connecting: %v\n", err.Error())
+	}
+	defer conn2.Close()
+	if _, err := conn2.Write([]byte("GET /slow HTTP/1.1\r\nHost: website1\r\n\r\n")); err != nil {
+		t.Fatalf("Error writing request: %v\n", err.Error())
+	}
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected Shutdown to return the context's error but got: %v\n", err)
+	}
+}
+
+func TestCustomHandler(t *testing.T) {
+	virtualHosts := parsevhconfig(t, "../../virtual_hosts.yaml", "../../docroot_dirs")
+	mux := tritonhttp.NewServeMux(&tritonhttp.FileHandler{VirtualHosts: virtualHosts})
+	mux.HandleFunc("/hello", func(res *tritonhttp.Response, req *tritonhttp.Request) {
+		res.Headers.Set("Content-Type", "text/plain")
+		res.Body = strings.NewReader("hello " + req.Host)
+	})
+	port := servetritonhttpd(t, &tritonhttp.Server{
+		VirtualHosts: virtualHosts,
+		Handler:      mux,
+	})
+
+	req := fmt.Sprint("GET /hello HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"\r\n",
+		"GET /index.html HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"Connection: close\r\n",
+		"\r\n",
+	)
+
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+	if err != nil {
+		t.Fatalf("Error fetching request: %v\n", err.Error())
+	}
+	respreader := bufio.NewReader(bytes.NewReader(respbytes))
+
+	// response 1: the custom endpoint
+	resp, err := http.ReadResponse(respreader, nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Error reading response body: %v\n", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "hello website1" {
+		t.Fatalf("Expected 200 \"hello website1\" but got %v %q\n", resp.StatusCode, body)
+	}
+
+	// response 2: falls through to the static files
+	resp, err = http.ReadResponse(respreader, nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	if resp.StatusCode != 200 || resp.ContentLength != 377 {
+		t.Fatalf("Expected 200 with content length 377 but got %v with %v\n", resp.StatusCode, resp.ContentLength)
+	}
+	resp.Body.Close()
+}
+
+func TestMiddleware(t *testing.T) {
+	virtualHosts := parsevhconfig(t, "../../virtual_hosts.yaml", "../../docroot_dirs")
+
+	// each layer appends its name to X-Order on the way out
+	order := func(name string) tritonhttp.Middleware {
+		return func(next tritonhttp.Handler) tritonhttp.Handler {
+			return tritonhttp.HandlerFunc(func(res *tritonhttp.Response, req *tritonhttp.Request) {
+				next.ServeTritonHTTP(res, req)
+				res.Headers.Set("X-Order", res.Headers.Get("X-Order")+name)
+			})
+		}
+	}
+	mux := tritonhttp.NewServeMux(&tritonhttp.FileHandler{VirtualHosts: virtualHosts})
+	mux.HandleFunc("/panic", func(res *tritonhttp.Response, req *tritonhttp.Request) {
+		panic("boom")
+	})
+	port := servetritonhttpd(t, &tritonhttp.Server{
+		VirtualHosts: virtualHosts,
+		Handler:      mux,
+		Middleware:   []tritonhttp.Middleware{order("a"), tritonhttp.Recover(nil)},
+		HostMiddleware: map[string][]tritonhttp.Middleware{
+			"website2": {order("b"), tritonhttp.BasicAuth("test", func(user, password string) bool {
+				return user == "admin" && password == "secret"
+			})},
+		},
+	})
+
+	tests := []struct {
+		name   string
+		req    string
+		status int
+		order  string
+	}{
+		{"server", "GET / HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n", 200, "a"},
+		{"host", "GET / HTTP/1.1\r\nHost: website2\r\nConnection: close\r\nAuthorization: Basic YWRtaW46c2VjcmV0\r\n\r\n", 200, "ba"},
+		{"unauthorized", "GET / HTTP/1.1\r\nHost: website2\r\nConnection: close\r\n\r\n", 401, "ba"},
+		{"panic", "GET /panic HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n", 500, "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(tt.req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+			if got := resp.Header.Get("X-Order"); got != tt.order {
+				t.Fatalf("Expected middleware order %q but got %q\n", tt.order, got)
+			}
+		})
+	}
+}
+
+func TestHead(t *testing.T) {
+	port := launchhttpd(t)
+
+	req := fmt.Sprint("HEAD /kitten.jpg HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"\r\n",
+		"GET /kitten.jpg HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"Connection: close\r\n",
+		"\r\n",
+	)
+
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+	if err != nil {
+		t.Fatalf("Error fetching request: %v\n", err.Error())
+	}
+	respreader := bufio.NewReader(bytes.NewReader(respbytes))
+
+	head, err := http.ReadResponse(respreader, &http.Request{Method: "HEAD"})
+	if err != nil {
+		t.Fatalf("got an error parsing the HEAD response: %v\n", err.Error())
+	}
+	head.Body.Close()
+
+	// If the HEAD response had a body, the GET response would not parse
+	get, err := http.ReadResponse(respreader, nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the GET response: %v\n", err.Error())
+	}
+	get.Body.Close()
+
+	if head.StatusCode != 200 {
+		t.Fatalf("Expected response code of 200 but got: %v\n", head.StatusCode)
+	}
+	for _, key := range []string{"Content-Length", "Content-Type", "Last-Modified"} {
+		if head.Header.Get(key) == "" || head.Header.Get(key) != get.Header.Get(key) {
+			t.Fatalf("Expected HEAD %v %q to match GET %q\n", key, head.Header.Get(key), get.Header.Get(key))
+		}
+	}
+}
+
+func TestUnsupportedMethods(t *testing.T) {
+	port := launchhttpd(t)
+
+	req := fmt.Sprint("FOO / HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"\r\n",
+		"POST / HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"\r\n",
+		"GET / HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"Connection: close\r\n",
+		"\r\n",
+	)
+
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+	if err != nil {
+		t.Fatalf("Error fetching request: %v\n", err.Error())
+	}
+	respreader := bufio.NewReader(bytes.NewReader(respbytes))
+
+	for _, want := range []int{501, 405, 200} {
+		resp, err := http.ReadResponse(respreader, nil)
+		if err != nil {
+			t.Fatalf("got an error parsing the %v response: %v\n", want, err.Error())
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("Expected response code of %v but got: %v\n", want, resp.StatusCode)
+		}
+		if want == 405 && resp.Header.Get("Allow") != "GET, HEAD, OPTIONS" {
+			t.Fatalf("Expected Allow header \"GET, HEAD, OPTIONS\" but got %q\n", resp.Header.Get("Allow"))
+		}
+	}
+}
+
+func TestIfModifiedSince(t *testing.T) {
+	port := launchhttpd(t)
+
+	info, err := os.Stat("../../docroot_dirs/htdocs1/index.html")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	modtime := info.ModTime()
+
+	tests := []struct {
+		name   string
+		since  string
+		status int
+	}{
+		{"unchanged", tritonhttp.FormatTime(modtime), 304},
+		{"unchanged-rfc850", modtime.UTC().Format("Monday, 02-Jan-06 15:04:05 GMT"), 304},
+		{"unchanged-asctime", modtime.UTC().Format("Mon Jan _2 15:04:05 2006"), 304},
+		{"changed", tritonhttp.FormatTime(modtime.Add(-time.Hour)), 200},
+		{"invalid", "not a date", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fmt.Sprint("GET /index.html HTTP/1.1\r\n",
+				"Host: website1\r\n",
+				"If-Modified-Since: "+tt.since+"\r\n",
+				"Connection: close\r\n",
+				"\r\n")
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+			if tt.status == 304 && (len(body) != 0 || resp.Header.Get("Last-Modified") == "") {
+				t.Fatalf("Expected 304 with Last-Modified and no body, got headers %v and %v bytes\n", resp.Header, len(body))
+			}
+		})
+	}
+}
+
+func TestRequestBody(t *testing.T) {
+	virtualHosts := parsevhconfig(t, "../../virtual_hosts.yaml", "../../docroot_dirs")
+	mux := tritonhttp.NewServeMux(&tritonhttp.FileHandler{VirtualHosts: virtualHosts})
+	mux.HandleFunc("/echo", func(res *tritonhttp.Response, req *tritonhttp.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return // the server answers with a 413
+		}
+		res.Body = bytes.NewReader(body)
+	})
+	port := servetritonhttpd(t, &tritonhttp.Server{
+		VirtualHosts: virtualHosts,
+		Handler:      mux,
+		MaxBodyBytes: 10,
+	})
+
+	tests := []struct {
+		name     string
+		req      string
+		statuses []int
+		body     string
+	}{
+		{"echo", "POST /echo HTTP/1.1\r\nHost: website1\r\nContent-Length: 5\r\n\r\nhello" +
+			"GET / HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n", []int{200, 200}, "hello"},
+		{"echo chunked", "POST /echo HTTP/1.1\r\nHost: website1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhe\r\n3\r\nllo\r\n0\r\n\r\n" +
+			"GET / HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n", []int{200, 200}, "hello"},
+		{"unread body", "POST / HTTP/1.1\r\nHost: website1\r\nContent-Length: 5\r\n\r\nhello" +
+			"GET / HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n", []int{405, 200}, ""},
+		{"too large", "POST /echo HTTP/1.1\r\nHost: website1\r\nContent-Length: 11\r\n\r\nhello world" +
+			"GET / HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n", []int{413}, ""},
+		{"too large chunked", "POST /echo HTTP/1.1\r\nHost: website1\r\nTransfer-Encoding: chunked\r\n\r\nb\r\nhello world\r\n0\r\n\r\n" +
+			"GET / HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n", []int{413}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(tt.req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+			respreader := bufio.NewReader(bytes.NewReader(respbytes))
+			for i, want := range tt.statuses {
+				resp, err := http.ReadResponse(respreader, nil)
+				if err != nil {
+					t.Fatalf("got an error parsing response %v: %v\n", i, err.Error())
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != want {
+					t.Fatalf("Expected response code of %v but got: %v\n", want, resp.StatusCode)
+				}
+				if i == 0 && tt.body != "" && string(body) != tt.body {
+					t.Fatalf("Expected body %q but got %q\n", tt.body, body)
+				}
+			}
+			if _, err := respreader.ReadByte(); err != io.EOF {
+				t.Fatalf("Expected no more than %v responses\n", len(tt.statuses))
+			}
+		})
+	}
+}
+
+func TestWebDAV(t *testing.T) {
+	docroot := t.TempDir()
+	dav := &tritonhttp.VirtualHost{HostName: "dav", Aliases: []string{"files"}, DocRoot: docroot, Writable: true}
+	virtualHosts := map[string]*tritonhttp.VirtualHost{
+		"dav":      dav,
+		"files":    dav,
+		"readonly": {DocRoot: docroot},
+	}
+	port := servetritonhttpd(t, &tritonhttp.Server{
+		VirtualHosts: virtualHosts,
+		DefaultHost:  "dav",
+		Handler:      &tritonhttp.FileHandler{VirtualHosts: virtualHosts},
+	})
+
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		headers string
+		body    string
+		status  int
+		want    string // expected substring of the response body
+	}{
+		{"mkcol", "MKCOL", "/dir", "", "", 201, ""},
+		{"mkcol exists", "MKCOL", "/dir", "", "", 405, ""},
+		{"mkcol no parent", "MKCOL", "/missing/dir", "", "", 409, ""},
+		{"put", "PUT", "/dir/a.txt", "", "hello", 201, ""},
+		{"get", "GET", "/dir/a.txt", "", "", 200, "hello"},
+		{"put replace", "PUT", "/dir/a.txt", "", "hello again", 204, ""},
+		{"put if-none-match", "PUT", "/dir/a.txt", "If-None-Match: *\r\n", "clobber", 412, ""},
+		{"put no parent", "PUT", "/missing/a.txt", "", "hello", 409, ""},
+		{"put traversal", "PUT", "/../escape.txt", "", "hello", 404, ""},
+		{"put readonly", "PUT", "/dir/b.txt", "", "hello", 405, ""},
+		{"copy", "COPY", "/dir/a.txt", "Destination: http://dav/dir/b.txt\r\n", "", 201, ""},
+		{"copy no overwrite", "COPY", "/dir/a.txt", "Destination: /dir/b.txt\r\nOverwrite: F\r\n", "", 412, ""},
+		{"copy other server", "COPY", "/dir/a.txt", "Destination: http://elsewhere/dir/b.txt\r\n", "", 502, ""},
+		{"copy other host", "COPY", "/dir/a.txt", "Destination: http://readonly/dir/b.txt\r\n", "", 502, ""},
+		{"copy to host from alias", "COPY", "/dir/a.txt", "Destination: http://dav/dir/d.txt\r\n", "", 201, ""},
+		{"copy to alias from alias", "COPY", "/dir/a.txt", "Destination: http://FILES:8080/dir/d.txt\r\n", "", 204, ""},
+		{"copy via default host", "COPY", "/dir/a.txt", "Destination: http://unknown.example/dir/e.txt\r\n", "", 201, ""},
+		{"get copy via default host", "GET", "/dir/e.txt", "", "", 200, "hello again"},
+		{"move", "MOVE", "/dir/b.txt", "Destination: /dir/c.txt\r\n", "", 201, ""},
+		{"get moved", "GET", "/dir/c.txt", "", "", 200, "hello again"},
+		{"get move source", "GET", "/dir/b.txt", "", "", 404, ""},
+		{"copy nul destination", "COPY", "/dir/c.txt", "Destination: /dir/d%00.txt\r\n", "", 400, ""},
+		{"mkcol sub", "MKCOL", "/dir/sub", "", "", 201, ""},
+		{"put sub", "PUT", "/dir/sub/x.txt", "", "x", 201, ""},
+		{"copy dir over file", "COPY", "/dir/sub", "Destination: /dir/c.txt\r\n", "", 204, ""},
+		{"get copied dir", "GET", "/dir/c.txt/x.txt", "", "", 200, "x"},
+		{"copy file over dir", "COPY", "/dir/a.txt", "Destination: /dir/c.txt\r\n", "", 204, ""},
+		{"get copied file", "GET", "/dir/c.txt", "", "", 200, "hello again"},
+		{"move over file", "MOVE", "/dir/sub/x.txt", "Destination: /dir/a.txt\r\n", "", 204, ""},
+		{"get moved over", "GET", "/dir/a.txt", "", "", 200, "x"},
+		{"propfind", "PROPFIND", "/dir", "Depth: 1\r\n", "", 207, "<D:href>/dir/c.txt</D:href>"},
+		{"propfind infinity", "PROPFIND", "/dir", "Depth: infinity\r\n", "", 403, ""},
+		{"options", "OPTIONS", "/", "", "", 200, ""},
+		{"delete root", "DELETE", "/", "", "", 403, ""},
+		{"delete", "DELETE", "/dir", "", "", 204, ""},
+		{"get deleted", "GET", "/dir/a.txt", "", "", 404, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := "dav"
+			switch {
+			case strings.HasSuffix(tt.name, "readonly"):
+				host = "readonly"
+			case strings.HasSuffix(tt.name, "from alias"):
+				host = "files"
+			case strings.HasSuffix(tt.name, "default host"):
+				host = "unknown.example"
+			}
+			req := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\nContent-Length: %d\r\n%s\r\n%s",
+				tt.method, tt.url, host, len(tt.body), tt.headers, tt.body)
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+			if !strings.Contains(string(body), tt.want) {
+				t.Fatalf("Expected body to contain %q but got %q\n", tt.want, body)
+			}
+			// Temporary files and directories must not outlive the request
+			filepath.WalkDir(docroot, func(p string, d fs.DirEntry, err error) error {
+				if err == nil && strings.HasPrefix(d.Name(), ".") {
+					t.Fatalf("Leftover temporary entry %v\n", p)
+				}
+				return nil
+			})
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(docroot), "escape.txt")); err == nil {
+		t.Fatal("PUT escaped the docroot")
+	}
+}
+
+func TestRequestTarget(t *testing.T) {
+	docroot := t.TempDir()
+	if err := os.WriteFile(filepath.Join(docroot, "my file.html"), []byte("spaced"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	virtualHosts := map[string]*tritonhttp.VirtualHost{"website1": {DocRoot: docroot}}
+	port := servetritonhttpd(t, &tritonhttp.Server{VirtualHosts: virtualHosts})
+
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/my%20file.html", 200},
+		{"/my%20file.html?v=2", 200},
+		{"/my%20file.html%3Fv=2", 404},
+		{"/..%2F..%2Fetc%2Fpasswd", 400},
+		{"/my%20file.html%00.txt", 400},
+	}
+	for _, tt := range tests {
+		req := "GET " + tt.target + " HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n"
+		respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+		if err != nil {
+			t.Fatalf("Error fetching request: %v\n", err.Error())
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+		if err != nil {
+			t.Fatalf("got an error parsing the response: %v\n", err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Fatalf("Expected response code of %v for %v but got: %v\n", tt.status, tt.target, resp.StatusCode)
+		}
+	}
+}
+
+func TestAbsoluteAndAsteriskForm(t *testing.T) {
+	port := launchhttpd(t)
+
+	req := fmt.Sprint("GET http://website2/index.html HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"\r\n",
+		"OPTIONS * HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"Connection: close\r\n",
+		"\r\n",
+	)
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+	if err != nil {
+		t.Fatalf("Error fetching request: %v\n", err.Error())
+	}
+	respreader := bufio.NewReader(bytes.NewReader(respbytes))
+
+	// The absolute-form target selects website2 despite the Host header
+	resp, err := http.ReadResponse(respreader, nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	website2, err := os.Stat("../../docroot_dirs/htdocs2/index.html")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp.StatusCode != 200 || resp.ContentLength != website2.Size() {
+		t.Fatalf("Expected website2's index.html but got %v with length %v\n", resp.StatusCode, resp.ContentLength)
+	}
+
+	resp, err = http.ReadResponse(respreader, nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Allow") == "" {
+		t.Fatalf("Expected OPTIONS * to list the allowed methods but got %v %v\n", resp.StatusCode, resp.Header)
+	}
+}
+
+func TestHeaderCase(t *testing.T) {
+	virtualHosts := parsevhconfig(t, "../../virtual_hosts.yaml", "../../docroot_dirs")
+	mux := tritonhttp.NewServeMux(&tritonhttp.FileHandler{VirtualHosts: virtualHosts})
+	mux.HandleFunc("/cookies", func(res *tritonhttp.Response, req *tritonhttp.Request) {
+		for _, value := range req.Headers.Values("X-Flavour") {
+			res.Headers.Add("Set-Cookie", "flavour="+value)
+		}
+	})
+	port := servetritonhttpd(t, &tritonhttp.Server{
+		VirtualHosts: virtualHosts,
+		Handler:      mux,
+	})
+
+	req := fmt.Sprint("GET /index.html HTTP/1.1\r\n",
+		"host: website1\r\n",
+		"\r\n",
+		"GET /cookies HTTP/1.1\r\n",
+		"HOST: website1\r\n",
+		"x-flavour: oat\r\n",
+		"X-FLAVOUR: rye\r\n",
+		"connection: close\r\n",
+		"\r\n",
+	)
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+	if err != nil {
+		t.Fatalf("Error fetching request: %v\n", err.Error())
+	}
+	respreader := bufio.NewReader(bytes.NewReader(respbytes))
+
+	// A lowercase Host header still selects the virtual host
+	resp, err := http.ReadResponse(respreader, nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected response code of 200 for a lowercase Host header but got: %v\n", resp.StatusCode)
+	}
+
+	// Repeated headers keep every value, on a line each
+	resp, err = http.ReadResponse(respreader, nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	resp.Body.Close()
+	cookies := resp.Header.Values("Set-Cookie")
+	if len(cookies) != 2 || cookies[0] != "flavour=oat" || cookies[1] != "flavour=rye" {
+		t.Fatalf("Expected two Set-Cookie headers but got %v\n", cookies)
+	}
+	if !resp.Close {
+		t.Fatalf("Expected a lowercase connection: close to be honoured but got %v\n", resp.Header)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	virtualHosts := parsevhconfig(t, "../../virtual_hosts.yaml", "../../docroot_dirs")
+	port := servetritonhttpd(t, &tritonhttp.Server{
+		VirtualHosts:        virtualHosts,
+		MaxRequestLineBytes: 64,
+		MaxHeaderCount:      4,
+	})
+
+	tests := []struct {
+		name   string
+		req    string
+		status int
+	}{
+		{"long target", "GET /" + strings.Repeat("a", 64) + " HTTP/1.1\r\nHost: website1\r\n\r\n", 414},
+		{"many headers", "GET / HTTP/1.1\r\nHost: website1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n", 431},
+		{"huge header", "GET / HTTP/1.1\r\nHost: website1\r\nA: " + strings.Repeat("a", 1<<20) + "\r\n\r\n", 431},
+	}
+	for _, tt := range tests {
+		respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(tt.req))
+		if err != nil {
+			t.Fatalf("Error fetching request: %v\n", err.Error())
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+		if err != nil {
+			t.Fatalf("got an error parsing the response: %v\n", err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || !resp.Close {
+			t.Fatalf("Expected response code of %v and a closed connection for %v but got: %v\n", tt.status, tt.name, resp.StatusCode)
+		}
+	}
+}
+
+func TestHTTP10(t *testing.T) {
+	virtualHosts := parsevhconfig(t, "../../virtual_hosts.yaml", "../../docroot_dirs")
+	port := servetritonhttpd(t, &tritonhttp.Server{
+		VirtualHosts: virtualHosts,
+		DefaultHost:  "website1",
+	})
+	index, err := os.Stat("../../docroot_dirs/htdocs1/index.html")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Without Host, from the default virtual host; kept open on request
+	req := fmt.Sprint("GET /index.html HTTP/1.0\r\n",
+		"Connection: keep-alive\r\n",
+		"\r\n",
+		"HEAD /index.html HTTP/1.0\r\n",
+		"\r\n",
+	)
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+	if err != nil {
+		t.Fatalf("Error fetching request: %v\n", err.Error())
+	}
+	respreader := bufio.NewReader(bytes.NewReader(respbytes))
+	resp, err := http.ReadResponse(respreader, nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.ContentLength != index.Size() || resp.Header.Get("Connection") != "keep-alive" {
+		t.Fatalf("Expected a kept-alive 200 for website1's index.html but got %v %v\n", resp.StatusCode, resp.Header)
+	}
+
+	// Closed by default
+	resp, err = http.ReadResponse(respreader, &http.Request{Method: "HEAD"})
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || !resp.Close {
+		t.Fatalf("Expected a 200 that closes the connection but got %v %v\n", resp.StatusCode, resp.Header)
+	}
+
+	req = "GET / HTTP/2.0\r\nHost: website1\r\n\r\n"
+	respbytes, _, err = tritonhttp.Fetch("localhost", port, []byte(req))
+	if err != nil {
+		t.Fatalf("Error fetching request: %v\n", err.Error())
+	}
+	resp, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 505 {
+		t.Fatalf("Expected response code of 505 for HTTP/2.0 but got: %v\n", resp.StatusCode)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	mux := tritonhttp.NewServeMux(nil)
+	mux.HandleFunc("/upload", func(res *tritonhttp.Response, req *tritonhttp.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			res.HandleBadRequest()
+			return
+		}
+		res.Body = bytes.NewReader(body)
+	})
+	mux.HandleFunc("/refuse", func(res *tritonhttp.Response, req *tritonhttp.Request) {
+		res.HandleForbidden()
+	})
+	port := servetritonhttpd(t, &tritonhttp.Server{Handler: mux})
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	// The body is only sent once the server asks for it
+	fmt.Fprint(conn, "POST /upload HTTP/1.1\r\nHost: website1\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	if resp.StatusCode != 100 {
+		t.Fatalf("Expected response code of 100 but got: %v\n", resp.StatusCode)
+	}
+	fmt.Fprint(conn, "hello")
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "hello" || resp.Close {
+		t.Fatalf("Expected the body echoed on an open connection but got %v %q %v\n", resp.StatusCode, body, resp.Header)
+	}
+
+	// A handler that never reads the body answers without a 100
+	fmt.Fprint(conn, "POST /refuse HTTP/1.1\r\nHost: website1\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 403 || !resp.Close {
+		t.Fatalf("Expected a 403 that closes the connection but got %v %v\n", resp.StatusCode, resp.Header)
+	}
+
+	req := "POST /upload HTTP/1.1\r\nHost: website1\r\nContent-Length: 5\r\nExpect: teapot\r\n\r\nhello"
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+	if err != nil {
+		t.Fatalf("Error fetching request: %v\n", err.Error())
+	}
+	resp, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 417 {
+		t.Fatalf("Expected response code of 417 for an unknown expectation but got: %v\n", resp.StatusCode)
+	}
+}
+
+func TestVirtualHostRouting(t *testing.T) {
+	virtualHosts := parsevhconfig(t, "../../virtual_hosts.yaml", "../../docroot_dirs")
+	strict := servetritonhttpd(t, &tritonhttp.Server{VirtualHosts: virtualHosts})
+	fallback := servetritonhttpd(t, &tritonhttp.Server{VirtualHosts: virtualHosts, DefaultHost: "website2"})
+	website1, err := os.Stat("../../docroot_dirs/htdocs1/index.html")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	website2, err := os.Stat("../../docroot_dirs/htdocs2/index.html")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		name   string
+		port   string
+		host   string // the Host header line, if any
+		status int
+		length int64
+	}{
+		{"port and case", strict, "Host: WEBSITE1:" + strict + "\r\n", 200, website1.Size()},
+		{"unknown host", strict, "Host: example.com\r\n", 421, 0},
+		{"unknown host with default", fallback, "Host: example.com\r\n", 200, website2.Size()},
+		{"missing host", fallback, "", 400, 0},
+		{"invalid host", fallback, "Host: web site\r\n", 400, 0},
+		{"ipv6 literal", fallback, "Host: [::1]:" + fallback + "\r\n", 200, website2.Size()},
+	}
+	for _, tt := range tests {
+		req := "GET /index.html HTTP/1.1\r\n" + tt.host + "Connection: close\r\n\r\n"
+		respbytes, _, err := tritonhttp.Fetch("localhost", tt.port, []byte(req))
+		if err != nil {
+			t.Fatalf("Error fetching request: %v\n", err.Error())
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+		if err != nil {
+			t.Fatalf("got an error parsing the response: %v\n", err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || (tt.status == 200 && resp.ContentLength != tt.length) {
+			t.Fatalf("Expected response code of %v for %v but got: %v with length %v\n", tt.status, tt.name, resp.StatusCode, resp.ContentLength)
+		}
+	}
+}
+
+func TestWildcardAndRegexHosts(t *testing.T) {
+	virtualHosts := writevhconfig(t, map[string]string{
+		"previews/123/index.html": "pr 123",
+		"previews/456/index.html": "pr 456",
+		"staging/index.html":      "staging",
+	}, `virtual_hosts:
+  - hostName: "*.staging.local"
+    docRoot: "staging"
+  - hostName: '~^pr-(\d+)\.preview\.local$'
+    docRoot: "previews/${1}"
+`)
+	port := servetritonhttpd(t, &tritonhttp.Server{VirtualHosts: virtualHosts})
+
+	tests := []struct {
+		host   string
+		status int
+		body   string
+	}{
+		{"api.staging.local", 200, "staging"},
+		{"PR-456.preview.local:8080", 200, "pr 456"},
+		{"pr-123.preview.local", 200, "pr 123"},
+		{"pr-789.preview.local", 404, ""},
+		{"staging.local", 421, ""},
+	}
+	for _, tt := range tests {
+		req := "GET / HTTP/1.1\r\nHost: " + tt.host + "\r\nConnection: close\r\n\r\n"
+		respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+		if err != nil {
+			t.Fatalf("Error fetching request: %v\n", err.Error())
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+		if err != nil {
+			t.Fatalf("got an error parsing the response: %v\n", err.Error())
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != tt.status || (tt.status == 200 && string(body) != tt.body) {
+			t.Fatalf("Expected %v %q for %v but got %v %q\n", tt.status, tt.body, tt.host, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestAliasesAndCanonicalHost(t *testing.T) {
+	virtualHosts := writevhconfig(t, map[string]string{
+		"one/index.html": "one",
+		"two/index.html": "two",
+	}, `virtual_hosts:
+  - hostName: "website1"
+    aliases: ["www.website1", "*.w1.local"]
+    canonicalHost: "website1"
+    docRoot: "one"
+  - hostName: "website2"
+    aliases: ["w2"]
+    docRoot: "two"
+  - hostName: "secure"
+    aliases: ["www.secure"]
+    docRoot: "two"
+`)
+	deny := func(user, password string) bool { return false }
+	port := servetritonhttpd(t, &tritonhttp.Server{
+		VirtualHosts: virtualHosts,
+		// Aliases get the middleware of their host
+		HostMiddleware: map[string][]tritonhttp.Middleware{
+			"secure": {tritonhttp.BasicAuth("secure", deny)},
+		},
+	})
+
+	tests := []struct {
+		target   string
+		host     string
+		status   int
+		location string // or the body of a 200
+	}{
+		{"/index.html", "website1", 200, "one"},
+		{"/index.html", "w2", 200, "two"},
+		{"/my%20file.html?v=2", "WWW.website1:" + port, 301, "http://website1:" + port + "/my%20file.html?v=2"},
+		{"/", "a.w1.local", 301, "http://website1/"},
+		{"http://www.website1/x", "website1", 301, "http://website1/x"},
+		{"/index.html", "secure", 401, ""},
+		{"/index.html", "www.secure", 401, ""},
+	}
+	for _, tt := range tests {
+		req := "GET " + tt.target + " HTTP/1.1\r\nHost: " + tt.host + "\r\nConnection: close\r\n\r\n"
+		respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+		if err != nil {
+			t.Fatalf("Error fetching request: %v\n", err.Error())
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+		if err != nil {
+			t.Fatalf("got an error parsing the response: %v\n", err.Error())
+		}
+		body, _ := io.ReadAll(resp.Body)
+		got := resp.Header.Get("Location")
+		if resp.StatusCode == 200 {
+			got = string(body)
+		}
+		if resp.StatusCode != tt.status || got != tt.location {
+			t.Fatalf("Expected %v %q for %v on %v but got %v %q\n", tt.status, tt.location, tt.target, tt.host, resp.StatusCode, got)
+		}
+	}
+}
+
+func TestHostSettings(t *testing.T) {
+	files := map[string]string{
+		"one/home.html":       "home",
+		"one/errors/404.html": "not here",
+		"one/style.css":       "body {}",
+		"one/files/a.txt":     "a",
+		"one/files/b<c>.txt":  "b",
+		"two/index.html":      "two",
+	}
+	accessLog := filepath.Join(t.TempDir(), "access.log")
+	virtualHosts := writevhconfig(t, files, `defaults:
+  headers: {X-Served-By: tritonhttp}
+  cacheRules: [{match: "*.css", cacheControl: "max-age=3600"}]
+virtual_hosts:
+  - hostName: "website1"
+    docRoot: "one"
+    indexFiles: ["home.html"]
+    directoryListing: true
+    errorPages: {404: "/errors/404.html"}
+    accessLog: "`+accessLog+`"
+    maxBodyBytes: 4
+  - hostName: "website2"
+    docRoot: "two"
+    headers: {X-Served-By: two}
+`)
+	port := servetritonhttpd(t, &tritonhttp.Server{VirtualHosts: virtualHosts})
+
+	tests := []struct {
+		name    string
+		request string
+		status  int
+		body    string // a substring of the body
+		header  string // "Name: value" expected in the response
+	}{
+		{"index file", "GET / HTTP/1.1\r\nHost: website1\r\n", 200, "home", "X-Served-By: tritonhttp"},
+		{"directory listing", "GET /files/ HTTP/1.1\r\nHost: website1\r\n", 200, `<a href="./b%3Cc%3E.txt">b&lt;c&gt;.txt</a>`, "Content-Type: text/html; charset=utf-8"},
+		{"error page", "GET /missing HTTP/1.1\r\nHost: website1\r\n", 404, "not here", "Content-Type: text/html; charset=utf-8"},
+		{"cache rule", "GET /style.css HTTP/1.1\r\nHost: website1\r\n", 200, "body {}", "Cache-Control: max-age=3600"},
+		{"body limit", "POST /home.html HTTP/1.1\r\nHost: website1\r\nContent-Length: 5\r\n", 413, "", "X-Served-By: "},
+		{"other host", "GET / HTTP/1.1\r\nHost: website2\r\n", 200, "two", "X-Served-By: two"},
+		{"no listing", "GET /missing/ HTTP/1.1\r\nHost: website2\r\n", 404, "", "Content-Length: 0"},
+	}
+	for _, tt := range tests {
+		respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(tt.request+"Connection: close\r\n\r\n"))
+		if err != nil {
+			t.Fatalf("Error fetching request: %v\n", err.Error())
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+		if err != nil {
+			t.Fatalf("got an error parsing the response: %v\n", err.Error())
+		}
+		body, _ := io.ReadAll(resp.Body)
+		name, value, _ := strings.Cut(tt.header, ": ")
+		if resp.StatusCode != tt.status || !strings.Contains(string(body), tt.body) || resp.Header.Get(name) != value {
+			t.Fatalf("Expected %v with %q and %q for %v but got:\n%s", tt.status, tt.body, tt.header, tt.name, respbytes)
+		}
+	}
+
+	logged, err := os.ReadFile(accessLog)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(logged), `website1 "GET /style.css HTTP/1.1" 200 7`) || strings.Contains(string(logged), "website2") {
+		t.Fatalf("Unexpected access log:\n%s", logged)
+	}
+}
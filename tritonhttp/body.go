@@ -0,0 +1,224 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxBodyBytes is the largest request body a Server accepts when
+// Server.MaxBodyBytes is 0.
+const DefaultMaxBodyBytes = 10 << 20
+
+// ErrBodyTooLarge is returned when reading a request body that is larger
+// than the server allows. The server answers such requests with a 413.
+var ErrBodyTooLarge = errors.New("tritonhttp: request body too large")
+
+// setupBody frames the body of req, which follows the headers in br,
+// from its Transfer-Encoding or Content-Length header.
+func setupBody(req *Request, br *bufio.Reader, opts *parseOptions) error {
+	if req.Headers.Has("Transfer-Encoding") {
+		if req.Proto == "HTTP/1.0" {
+			// Transfer codings did not exist in HTTP/1.0, so a client
+			// sending one cannot be trusted to frame its body
+			return errors.New("transfer encoding in an HTTP/1.0 request")
+		}
+		te := req.Headers.list("Transfer-Encoding")
+		// Chunked must be the final coding, and the server does not
+		// decode any other codings
+		if !strings.EqualFold(strings.TrimSpace(te), "chunked") {
+			return fmt.Errorf("unsupported transfer encoding: %q", te)
+		}
+		if req.Headers.Has("Content-Length") {
+			if opts.strict {
+				return errors.New("both Content-Length and Transfer-Encoding")
+			}
+			// Transfer-Encoding wins, but a client that sends both may be
+			// trying to smuggle a request past a proxy that picked
+			// Content-Length, so the connection is not reused (RFC 9112,
+			// Section 6.3)
+			req.Headers.Del("Content-Length")
+			req.Close = true
+		}
+		req.ContentLength = -1
+		req.Body = &chunkedReader{br: br, req: req, opts: opts}
+		return nil
+	}
+	if req.Headers.Has("Content-Length") {
+		n, err := parseContentLength(req.Headers.Values("Content-Length"), opts)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = n
+		req.Body = io.LimitReader(br, n)
+		return nil
+	}
+	req.Body = eofReader{}
+	return nil
+}
+
+// parseContentLength parses the values of the Content-Length header. A
+// list of identical lengths, from a header repeated by some proxy, is
+// accepted unless opts is strict; differing lengths never are.
+func parseContentLength(values []string, opts *parseOptions) (int64, error) {
+	raw := strings.Join(values, ",")
+	if opts.strict && (len(values) != 1 || strings.Contains(raw, ",")) {
+		return 0, fmt.Errorf("repeated content length: %q", raw)
+	}
+	elements := strings.Split(raw, ",")
+	cl := strings.TrimSpace(elements[0])
+	for _, element := range elements[1:] {
+		if strings.TrimSpace(element) != cl {
+			return 0, fmt.Errorf("conflicting content lengths: %q", raw)
+		}
+	}
+	n, err := strconv.ParseInt(cl, 10, 64)
+	if err != nil || n < 0 || !isDigits(cl) {
+		return 0, fmt.Errorf("invalid content length: %q", raw)
+	}
+	return n, nil
+}
+
+// eofReader is the Body of a request without one.
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+// chunkedReader decodes a chunked request body, storing any trailer
+// fields that follow it in req.Trailers.
+type chunkedReader struct {
+	br   *bufio.Reader
+	req  *Request
+	opts *parseOptions
+	left int64 // bytes left in the current chunk
+	err  error
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if cr.left == 0 {
+		cr.left, cr.err = cr.readChunkSize()
+		if cr.err == nil && cr.left == 0 {
+			cr.err = cr.readTrailers()
+			if cr.err == nil {
+				cr.err = io.EOF
+			}
+		}
+		if cr.err != nil {
+			return 0, cr.err
+		}
+	}
+	if int64(len(p)) > cr.left {
+		p = p[:cr.left]
+	}
+	n, err := cr.br.Read(p)
+	cr.left -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && cr.left == 0 {
+		err = cr.readCRLF()
+	}
+	cr.err = err
+	return n, err
+}
+
+// readChunkSize reads a chunk-size line, ignoring any chunk extensions.
+// The line is limited like the request line.
+func (cr *chunkedReader) readChunkSize() (int64, error) {
+	line, err := readLine(cr.br, cr.opts, cr.opts.requestLineLimit())
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	size, _, _ := strings.Cut(line, ";")
+	size = strings.TrimSpace(size)
+	if size == "" || len(size) > 16 {
+		return 0, fmt.Errorf("invalid chunk size: %q", line)
+	}
+	n, err := strconv.ParseUint(size, 16, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chunk size: %q", line)
+	}
+	return int64(n), nil
+}
+
+func (cr *chunkedReader) readCRLF() error {
+	line, err := readLine(cr.br, cr.opts, cr.opts.requestLineLimit())
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if line != "" {
+		return errors.New("missing CRLF after chunk data")
+	}
+	return nil
+}
+
+func (cr *chunkedReader) readTrailers() error {
+	trailers := make(Header)
+	if err := parseHeaders(cr.br, trailers, cr.opts); err != nil {
+		return unexpectedEOF(err)
+	}
+	cr.req.Trailers = trailers
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// continueReader sends a 100 Continue interim response to w on the
+// first read from r, for a client that waits for one before sending the
+// body. A handler that never reads the body never asks for it.
+type continueReader struct {
+	r    io.Reader
+	w    io.Writer
+	sent bool
+	err  error
+}
+
+func (cr *continueReader) Read(p []byte) (int, error) {
+	if !cr.sent {
+		cr.sent = true
+		res := &Response{Proto: "HTTP/1.1", StatusCode: 100, StatusText: StatusText(100)}
+		cr.err = res.Write(cr.w)
+	}
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	return cr.r.Read(p)
+}
+
+// maxBytesReader returns ErrBodyTooLarge once more than n bytes have been
+// read from r.
+type maxBytesReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (mr *maxBytesReader) Read(p []byte) (int, error) {
+	if mr.exceeded {
+		return 0, ErrBodyTooLarge
+	}
+	// Read one byte more than allowed to tell a body of exactly n bytes
+	// from one that is too large
+	if int64(len(p)) > mr.n+1 {
+		p = p[:mr.n+1]
+	}
+	n, err := mr.r.Read(p)
+	if int64(n) > mr.n {
+		mr.exceeded = true
+		n = int(mr.n)
+		err = ErrBodyTooLarge
+	}
+	mr.n -= int64(n)
+	return n, err
+}
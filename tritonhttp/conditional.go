@@ -0,0 +1,160 @@
+package tritonhttp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ETagSource selects what the ETag of a static file is derived from.
+type ETagSource int
+
+const (
+	// ETagSizeModTime derives ETags from the file's size and modification
+	// time. It is cheap, but changes if the file is touched.
+	ETagSizeModTime ETagSource = iota
+	// ETagContentHash derives ETags from a SHA-256 hash of the contents.
+	// Hashes are cached until the file's size or modification time change.
+	ETagContentHash
+	// ETagNone disables ETags.
+	ETagNone
+)
+
+// hashCacheEntry remembers the content hash of a file as of a given size
+// and modification time.
+type hashCacheEntry struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+var hashCache sync.Map // file path -> hashCacheEntry
+
+// fileETag returns the ETag for the file at path, or "" if opts disable
+// ETags or the file cannot be hashed.
+func fileETag(path string, stats os.FileInfo, opts *FileOptions) string {
+	var tag string
+	switch opts.ETag {
+	case ETagSizeModTime:
+		tag = fmt.Sprintf("%x-%x", stats.Size(), stats.ModTime().UnixNano())
+	case ETagContentHash:
+		hash, err := contentHash(path, stats)
+		if err != nil {
+			return ""
+		}
+		tag = hash
+	default:
+		return ""
+	}
+	if opts.WeakETag {
+		return `W/"` + tag + `"`
+	}
+	return `"` + tag + `"`
+}
+
+func contentHash(path string, stats os.FileInfo) (string, error) {
+	if v, ok := hashCache.Load(path); ok {
+		entry := v.(hashCacheEntry)
+		if entry.size == stats.Size() && entry.modTime.Equal(stats.ModTime()) {
+			return entry.hash, nil
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil)[:16])
+	hashCache.Store(path, hashCacheEntry{size: stats.Size(), modTime: stats.ModTime(), hash: hash})
+	return hash, nil
+}
+
+// checkPreconditions evaluates the conditional request headers of req
+// against the current ETag and modification time of the file, in the
+// order given by RFC 9110, Section 13.2.2. If a precondition decides the
+// response, it turns res into a 304 or 412 and returns true.
+func (res *Response) checkPreconditions(req *Request, etag string, modTime time.Time) bool {
+	// HTTP dates only have second precision
+	modTime = modTime.Truncate(time.Second)
+
+	if req.Headers.Has("If-Match") {
+		if !etagListMatches(req.Headers.list("If-Match"), etag, true) {
+			res.HandlePreconditionFailed()
+			return true
+		}
+	} else if since, err := ParseHTTPTime(req.Headers.Get("If-Unmodified-Since")); err == nil {
+		if modTime.After(since) {
+			res.HandlePreconditionFailed()
+			return true
+		}
+	}
+
+	safe := req.Method == "GET" || req.Method == "HEAD"
+	if req.Headers.Has("If-None-Match") {
+		if etagListMatches(req.Headers.list("If-None-Match"), etag, false) {
+			if safe {
+				res.HandleNotModified()
+			} else {
+				res.HandlePreconditionFailed()
+			}
+			return true
+		}
+	} else if since, err := ParseHTTPTime(req.Headers.Get("If-Modified-Since")); err == nil && safe {
+		// absent or invalid dates are ignored
+		if !modTime.After(since) {
+			res.HandleNotModified()
+			return true
+		}
+	}
+	return false
+}
+
+// etagListMatches reports whether the If-Match or If-None-Match header
+// value list contains etag. "*" matches any existing file. The strong
+// comparison used by If-Match never matches weak ETags.
+func etagListMatches(list string, etag string, strong bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	if etag == "" || (strong && strings.HasPrefix(etag, "W/")) {
+		return false
+	}
+	for _, candidate := range splitETagList(list) {
+		if strong && strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// splitETagList splits a comma-separated list of entity tags, taking care
+// not to split on commas inside the quotes of an opaque tag.
+func splitETagList(list string) []string {
+	var tags []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(list); i++ {
+		switch list[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case ',':
+			if !inQuotes {
+				tags = append(tags, strings.TrimSpace(list[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(tags, strings.TrimSpace(list[start:]))
+}
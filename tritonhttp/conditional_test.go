@@ -0,0 +1,73 @@
+package tritonhttp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandleFilePreconditions(t *testing.T) {
+	docRoot := t.TempDir()
+	if err := os.WriteFile(filepath.Join(docRoot, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, time.July, 21, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(docRoot, "a.txt"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	// Learn the current ETags first
+	etags := make(map[ETagSource]string)
+	for _, source := range []ETagSource{ETagSizeModTime, ETagContentHash} {
+		res := &Response{}
+		res.HandleFile(docRoot, &Request{Method: "GET", URL: "/a.txt", Path: "/a.txt"}, &FileOptions{ETag: source})
+		etags[source] = res.Headers.Get("Etag")
+	}
+	etag := etags[ETagSizeModTime]
+	if etag == "" || etags[ETagContentHash] == "" || etag == etags[ETagContentHash] {
+		t.Fatalf("Expected distinct ETags per source, got %v", etags)
+	}
+
+	before := FormatTime(modTime.Add(-time.Hour))
+	after := FormatTime(modTime.Add(time.Hour))
+	tests := []struct {
+		name    string
+		method  string
+		headers Header
+		opts    FileOptions
+		status  int
+	}{
+		{"none", "GET", nil, FileOptions{}, 200},
+		{"if-none-match", "GET", Header{"If-None-Match": {etag}}, FileOptions{}, 304},
+		{"if-none-match list", "HEAD", Header{"If-None-Match": {`"x", ` + etag}}, FileOptions{}, 304},
+		{"if-none-match lines", "GET", Header{"If-None-Match": {`"x"`, etag}}, FileOptions{}, 304},
+		{"if-none-match star", "GET", Header{"If-None-Match": {"*"}}, FileOptions{}, 304},
+		{"if-none-match other", "GET", Header{"If-None-Match": {`"x"`}}, FileOptions{}, 200},
+		{"if-none-match weak", "GET", Header{"If-None-Match": {"W/" + etag}}, FileOptions{}, 304},
+		{"if-none-match beats if-modified-since", "GET", Header{"If-None-Match": {`"x"`}, "If-Modified-Since": {after}}, FileOptions{}, 200},
+		{"if-none-match content hash", "GET", Header{"If-None-Match": {etags[ETagContentHash]}}, FileOptions{ETag: ETagContentHash}, 304},
+		{"if-match", "GET", Header{"If-Match": {etag}}, FileOptions{}, 200},
+		{"if-match other", "GET", Header{"If-Match": {`"x"`}}, FileOptions{}, 412},
+		{"if-match weak", "GET", Header{"If-Match": {"W/" + etag}}, FileOptions{WeakETag: true}, 412},
+		{"if-unmodified-since", "GET", Header{"If-Unmodified-Since": {after}}, FileOptions{}, 200},
+		{"if-unmodified-since stale", "GET", Header{"If-Unmodified-Since": {before}}, FileOptions{}, 412},
+		{"etags disabled", "GET", Header{"If-None-Match": {etag}}, FileOptions{ETag: ETagNone}, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := tt.headers
+			if headers == nil {
+				headers = Header{}
+			}
+			res := &Response{}
+			res.HandleFile(docRoot, &Request{Method: tt.method, URL: "/a.txt", Path: "/a.txt", Headers: headers}, &tt.opts)
+			if res.StatusCode != tt.status {
+				t.Fatalf("Expected status %v but got %v", tt.status, res.StatusCode)
+			}
+			if tt.status != 200 && res.FilePath != "" {
+				t.Fatalf("Expected no body for a %v response", tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package tritonhttp
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+)
+
+// DefaultMaxMemory is how much of a multipart/form-data body
+// ParseMultipartForm keeps in memory when called through FormValue or
+// FormFile; file parts beyond it are spooled to temporary files.
+const DefaultMaxMemory = 32 << 20
+
+// ErrNotMultipart is returned by ParseMultipartForm when the request body
+// is not multipart/form-data.
+var ErrNotMultipart = errors.New("tritonhttp: request Content-Type isn't multipart/form-data")
+
+// ParseForm parses an application/x-www-form-urlencoded body of a POST,
+// PUT or PATCH request into PostForm, and sets Form to the body's fields
+// followed by the ones from the query string. It is a no-op once Form
+// has been parsed.
+func (req *Request) ParseForm() error {
+	if req.Form != nil {
+		return nil
+	}
+	req.Form = make(url.Values)
+	req.PostForm = make(url.Values)
+	defer copyValues(req.Form, req.Query)
+	if !hasFormBody(req.Method) {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Headers.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return nil
+	}
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return err
+	}
+	req.PostForm = values
+	copyValues(req.Form, values)
+	return nil
+}
+
+// ParseMultipartForm parses a multipart/form-data body into MultipartForm,
+// and copies its fields into Form and PostForm. Up to maxMemory bytes of
+// file parts are kept in memory; larger files are spooled to temporary
+// files on disk, which the server removes once the response has been
+// written.
+func (req *Request) ParseMultipartForm(maxMemory int64) error {
+	if req.MultipartForm != nil {
+		return nil
+	}
+	if err := req.ParseForm(); err != nil {
+		return err
+	}
+	mediaType, params, err := mime.ParseMediaType(req.Headers.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return ErrNotMultipart
+	}
+	form, err := multipart.NewReader(req.Body, params["boundary"]).ReadForm(maxMemory)
+	if err != nil {
+		return err
+	}
+	req.MultipartForm = form
+	copyValues(req.PostForm, form.Value)
+	copyValues(req.Form, form.Value)
+	return nil
+}
+
+// FormValue returns the first value for key in Form, parsing the body as
+// a form if needed. Parse errors are ignored; call ParseForm or
+// ParseMultipartForm to see them.
+func (req *Request) FormValue(key string) string {
+	if req.MultipartForm == nil {
+		req.ParseMultipartForm(DefaultMaxMemory)
+	}
+	return req.Form.Get(key)
+}
+
+// PostFormValue is like FormValue, but only looks at the request body.
+func (req *Request) PostFormValue(key string) string {
+	if req.MultipartForm == nil {
+		req.ParseMultipartForm(DefaultMaxMemory)
+	}
+	return req.PostForm.Get(key)
+}
+
+// FormFile returns the first uploaded file for key, parsing the body as
+// multipart/form-data if needed.
+func (req *Request) FormFile(key string) (multipart.File, *multipart.FileHeader, error) {
+	if req.MultipartForm == nil {
+		if err := req.ParseMultipartForm(DefaultMaxMemory); err != nil {
+			return nil, nil, err
+		}
+	}
+	files := req.MultipartForm.File[key]
+	if len(files) == 0 {
+		return nil, nil, errors.New("tritonhttp: no such file")
+	}
+	f, err := files[0].Open()
+	return f, files[0], err
+}
+
+// removeMultipartFiles deletes any files that ParseMultipartForm spooled
+// to disk.
+func (req *Request) removeMultipartFiles() {
+	if req.MultipartForm != nil {
+		req.MultipartForm.RemoveAll()
+	}
+}
+
+func hasFormBody(method string) bool {
+	return method == "POST" || method == "PUT" || method == "PATCH"
+}
+
+func copyValues(dst, src url.Values) {
+	for key, values := range src {
+		dst[key] = append(dst[key], values...)
+	}
+}
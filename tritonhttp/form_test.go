@@ -0,0 +1,89 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime/multipart"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readTestRequest parses raw as a request with the given body.
+func readTestRequest(t *testing.T, head string, body []byte) *Request {
+	raw := head + "Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + string(body)
+	req, err, _ := ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	return req
+}
+
+func TestParseForm(t *testing.T) {
+	req := readTestRequest(t, "POST /form?tag=q&src=query HTTP/1.1\r\nHost: a\r\nContent-Type: application/x-www-form-urlencoded\r\n",
+		[]byte("name=triton&tag=a&tag=b+c"))
+	if err := req.ParseForm(); err != nil {
+		t.Fatalf("ParseForm: %v", err)
+	}
+	if req.FormValue("name") != "triton" || strings.Join(req.PostForm["tag"], ",") != "a,b c" {
+		t.Fatalf("Unexpected form %v", req.Form)
+	}
+	// Body fields come before query fields
+	if strings.Join(req.Form["tag"], ",") != "a,b c,q" || req.FormValue("src") != "query" || req.PostFormValue("src") != "" {
+		t.Fatalf("Unexpected merge of query and body %v", req.Form)
+	}
+
+	// Bodies of GET requests are not forms
+	req = readTestRequest(t, "GET / HTTP/1.1\r\nHost: a\r\nContent-Type: application/x-www-form-urlencoded\r\n",
+		[]byte("name=triton"))
+	if req.FormValue("name") != "" {
+		t.Fatalf("Expected GET body to be ignored, got %v", req.Form)
+	}
+}
+
+func TestParseMultipartForm(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("title", "seal")
+	fw, err := mw.CreateFormFile("upload", "seal.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := bytes.Repeat([]byte("0123456789"), 1000)
+	fw.Write(upload)
+	mw.Close()
+
+	req := readTestRequest(t, "POST /upload HTTP/1.1\r\nHost: a\r\nContent-Type: "+mw.FormDataContentType()+"\r\n", body.Bytes())
+	// Keep less than the upload in memory, so it is spooled to disk
+	if err := req.ParseMultipartForm(1024); err != nil {
+		t.Fatalf("ParseMultipartForm: %v", err)
+	}
+	if req.FormValue("title") != "seal" || req.PostFormValue("title") != "seal" {
+		t.Fatalf("Unexpected form %v", req.Form)
+	}
+	f, header, err := req.FormFile("upload")
+	if err != nil {
+		t.Fatalf("FormFile: %v", err)
+	}
+	defer f.Close()
+	spooled, ok := f.(*os.File)
+	if !ok || header.Filename != "seal.bin" {
+		t.Fatalf("Expected seal.bin to be spooled to disk, got %T %v", f, header.Filename)
+	}
+	got, _ := io.ReadAll(f)
+	if !bytes.Equal(got, upload) {
+		t.Fatal("Uploaded file contents do not match")
+	}
+
+	req.removeMultipartFiles()
+	if _, err := os.Stat(spooled.Name()); !os.IsNotExist(err) {
+		t.Fatalf("Expected spooled file to be removed, got %v", err)
+	}
+
+	req = readTestRequest(t, "POST /upload HTTP/1.1\r\nHost: a\r\nContent-Type: text/plain\r\n", []byte("x"))
+	if err := req.ParseMultipartForm(1024); err != ErrNotMultipart {
+		t.Fatalf("Expected ErrNotMultipart but got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package tritonhttp
+
+import (
+	"sort"
+	"strings"
+)
+
+// A Handler responds to a request by filling in res: its status, its
+// headers, and either a FilePath or a Body to send back. The server
+// writes res to the client once ServeTritonHTTP returns.
+type Handler interface {
+	ServeTritonHTTP(res *Response, req *Request)
+}
+
+// HandlerFunc lets an ordinary function be used as a Handler.
+type HandlerFunc func(res *Response, req *Request)
+
+// ServeTritonHTTP calls f(res, req).
+func (f HandlerFunc) ServeTritonHTTP(res *Response, req *Request) {
+	f(res, req)
+}
+
+// FileHandler serves static files from the docRoot of the virtual host
+// named in the request's Host header. This is what a Server does when
+// no other Handler is configured. On writable hosts it also supports the
+// WebDAV methods PUT, DELETE, MKCOL, COPY, MOVE and PROPFIND.
+type FileHandler struct {
+	// VirtualHosts maps host names to virtual hosts, like
+	// Server.VirtualHosts.
+	VirtualHosts map[string]*VirtualHost
+
+	// Options controls how files are served. The IndexFiles and
+	// DirectoryListing settings of a virtual host override those here.
+	Options FileOptions
+}
+
+// FileOptions controls how static files are served. The zero value
+// serves strong ETags derived from each file's size and modification time.
+type FileOptions struct {
+	// ETag selects what ETags are derived from, or disables them.
+	ETag ETagSource
+
+	// WeakETag marks ETags as weak ("W/..."), for files whose content may
+	// change in ways that do not matter to clients.
+	WeakETag bool
+
+	// IndexFiles are the files tried, in order, for a path ending in
+	// "/". If there are none, "index.html" is tried.
+	IndexFiles []string
+
+	// DirectoryListing lists the contents of a directory that has none
+	// of the IndexFiles, instead of answering 404.
+	DirectoryListing bool
+}
+
+func (opts *FileOptions) indexFiles() []string {
+	if len(opts.IndexFiles) > 0 {
+		return opts.IndexFiles
+	}
+	return []string{"index.html"}
+}
+
+func (h *FileHandler) ServeTritonHTTP(res *Response, req *Request) {
+	vh, _ := resolveVirtualHost(h.VirtualHosts, req.Host)
+	writable := vh.host != nil && vh.host.Writable
+	opts := h.options(vh.host)
+	switch {
+	case req.Method == "GET" || req.Method == "HEAD":
+		res.HandleFile(vh.docRoot, req, opts) // pass the docRoot of the host to HandleFile
+	case req.Method == "OPTIONS":
+		res.HandleOptions(writable)
+	case writable && res.serveWebDAV(vh.docRoot, req, opts, h.VirtualHosts):
+	default:
+		res.HandleMethodNotAllowed(allowedMethods(writable)...)
+	}
+}
+
+// options returns the FileOptions for serving the files of vh.
+func (h *FileHandler) options(vh *VirtualHost) *FileOptions {
+	opts := h.Options
+	if vh != nil {
+		if len(vh.IndexFiles) > 0 {
+			opts.IndexFiles = vh.IndexFiles
+		}
+		if vh.DirectoryListing != nil {
+			opts.DirectoryListing = *vh.DirectoryListing
+		}
+	}
+	return &opts
+}
+
+// ServeMux dispatches requests to the handler registered for the longest
+// pattern matching the request path. A pattern ending in "/" matches every
+// path below it, e.g. "/api/" matches "/api/users"; any other pattern only
+// matches that exact path. Requests matching no pattern go to NotFound,
+// or get a 404 if NotFound is nil.
+type ServeMux struct {
+	// NotFound handles requests that match no pattern, e.g. a FileHandler
+	// so that custom endpoints can be mounted next to static files.
+	NotFound Handler
+
+	handlers map[string]Handler
+	patterns []string // sorted longest first
+}
+
+// NewServeMux returns an empty ServeMux that falls back to notFound.
+func NewServeMux(notFound Handler) *ServeMux {
+	return &ServeMux{NotFound: notFound, handlers: make(map[string]Handler)}
+}
+
+// Handle registers h for pattern, replacing any handler already
+// registered for the same pattern.
+func (mux *ServeMux) Handle(pattern string, h Handler) {
+	if !strings.HasPrefix(pattern, "/") {
+		panic("tritonhttp: pattern must begin with '/': " + pattern)
+	}
+	if mux.handlers == nil {
+		mux.handlers = make(map[string]Handler)
+	}
+	if _, ok := mux.handlers[pattern]; !ok {
+		mux.patterns = append(mux.patterns, pattern)
+		sort.Slice(mux.patterns, func(i, j int) bool {
+			return len(mux.patterns[i]) > len(mux.patterns[j])
+		})
+	}
+	mux.handlers[pattern] = h
+}
+
+// HandleFunc registers f for pattern.
+func (mux *ServeMux) HandleFunc(pattern string, f func(res *Response, req *Request)) {
+	mux.Handle(pattern, HandlerFunc(f))
+}
+
+func (mux *ServeMux) ServeTritonHTTP(res *Response, req *Request) {
+	mux.handler(req).ServeTritonHTTP(res, req)
+}
+
+// handler returns the Handler that should serve req.
+func (mux *ServeMux) handler(req *Request) Handler {
+	for _, pattern := range mux.patterns {
+		if req.Path == pattern || (strings.HasSuffix(pattern, "/") && strings.HasPrefix(req.Path, pattern)) {
+			return mux.handlers[pattern]
+		}
+	}
+	if mux.NotFound != nil {
+		return mux.NotFound
+	}
+	return HandlerFunc(func(res *Response, req *Request) {
+		res.HandleStatusNotFound()
+	})
+}
@@ -0,0 +1,91 @@
+package tritonhttp
+
+import (
+	"sort"
+	"strings"
+)
+
+// A Header holds the fields of a request or response header. Keys are
+// canonical field names, as returned by CanonicalHeaderKey, and a field
+// that appears several times has one value per occurrence, in order.
+//
+// The methods canonicalize the key they are given; code indexing the map
+// directly must use canonical keys itself.
+type Header map[string][]string
+
+// Add appends value to the values of the field key.
+func (h Header) Add(key, value string) {
+	key = CanonicalHeaderKey(key)
+	h[key] = append(h[key], value)
+}
+
+// Set replaces any values of the field key with value.
+func (h Header) Set(key, value string) {
+	h[CanonicalHeaderKey(key)] = []string{value}
+}
+
+// Get returns the first value of the field key, or "" if it is not set.
+func (h Header) Get(key string) string {
+	if values := h[CanonicalHeaderKey(key)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Values returns every value of the field key. The slice is not a copy.
+func (h Header) Values(key string) []string {
+	return h[CanonicalHeaderKey(key)]
+}
+
+// Has reports whether the field key is set, even to an empty value.
+func (h Header) Has(key string) bool {
+	_, ok := h[CanonicalHeaderKey(key)]
+	return ok
+}
+
+// Del removes the field key.
+func (h Header) Del(key string) {
+	delete(h, CanonicalHeaderKey(key))
+}
+
+// Clone returns a copy of h, or nil if h is nil.
+func (h Header) Clone() Header {
+	if h == nil {
+		return nil
+	}
+	clone := make(Header, len(h))
+	for key, values := range h {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// list returns the values of the comma-separated list field key, which
+// may have been split over several lines, as a single line.
+func (h Header) list(key string) string {
+	return strings.Join(h.Values(key), ", ")
+}
+
+// hasToken reports whether the comma-separated list field key contains
+// token, ignoring case, as for "Connection: keep-alive, close".
+func (h Header) hasToken(key, token string) bool {
+	for _, value := range h.Values(key) {
+		for _, element := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(element), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of h in order, so that headers are always
+// written the same way.
+func (h Header) sortedKeys() []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,46 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestHeader(t *testing.T) {
+	h := make(Header)
+	h.Add("cache-control", "no-cache")
+	h.Add("CACHE-CONTROL", "no-store")
+	if got := h.Values("Cache-Control"); len(got) != 2 || got[0] != "no-cache" || got[1] != "no-store" {
+		t.Fatalf("Expected both values under the canonical key but got %v", h)
+	}
+	if h.Get("cache-control") != "no-cache" || h.list("Cache-Control") != "no-cache, no-store" {
+		t.Fatalf("Expected the first value from Get and all from list but got %v", h)
+	}
+	h.Set("Cache-Control", "max-age=60")
+	if got := h.Values("Cache-Control"); len(got) != 1 || got[0] != "max-age=60" {
+		t.Fatalf("Expected Set to replace the values but got %v", got)
+	}
+	h.Del("cache-control")
+	if h.Has("Cache-Control") || h.Get("Cache-Control") != "" {
+		t.Fatalf("Expected Del to remove the field but got %v", h)
+	}
+
+	h.Add("Connection", "keep-alive, Close")
+	if !h.hasToken("connection", "close") || h.hasToken("Connection", "upgrade") {
+		t.Fatalf("Expected the Connection tokens to be found case-insensitively in %v", h)
+	}
+}
+
+func TestReadRequestHeaders(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nhost: website1\r\naccept: text/html\r\nAccept: */*\r\n\r\n"))
+	req, err, _ := ReadRequest(br)
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	if req.Host != "website1" {
+		t.Fatalf("Expected Host website1 from a lowercase header but got %q", req.Host)
+	}
+	if got := req.Headers["Accept"]; len(got) != 2 || got[0] != "text/html" || got[1] != "*/*" {
+		t.Fatalf("Expected both Accept values in order but got %v", req.Headers)
+	}
+}
@@ -0,0 +1,252 @@
+package tritonhttp
+
+import (
+	"log"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultReadTimeout is how long a Server waits for a request when
+// Server.ReadTimeout is 0.
+const DefaultReadTimeout = 5 * time.Second
+
+// HostSettings are the settings of a virtual host that the virtual
+// hosting config file may also give once for all hosts, in its defaults
+// block. A setting a host leaves at its zero value is taken from the
+// defaults, and failing that from the Server or FileHandler.
+type HostSettings struct {
+	// IndexFiles are the files tried, in order, for a path ending in
+	// "/". If there are none, "index.html" is tried.
+	IndexFiles []string `yaml:"indexFiles"`
+
+	// DirectoryListing lists the contents of a directory that has none
+	// of the IndexFiles, instead of answering 404.
+	DirectoryListing *bool `yaml:"directoryListing"`
+
+	// ErrorPages maps status codes to files below the docRoot that are
+	// sent as the body of handler responses with that status and no
+	// body of their own, e.g. {404: "/errors/404.html"}.
+	ErrorPages map[int]string `yaml:"errorPages"`
+
+	// Headers are added to every handler response, overriding headers of
+	// the same name set by the handler.
+	Headers map[string]string `yaml:"headers"`
+
+	// CacheRules set the Cache-Control header of successful responses;
+	// the first rule matching the path wins.
+	CacheRules []CacheRule `yaml:"cacheRules"`
+
+	// AccessLog is the path of a file that every request for the host is
+	// logged to, in the format of Logging.
+	AccessLog string `yaml:"accessLog"`
+
+	// ReadTimeout and WriteTimeout override Server.ReadTimeout and
+	// Server.WriteTimeout, e.g. "30s".
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+
+	// MaxBodyBytes overrides Server.MaxBodyBytes.
+	MaxBodyBytes int64 `yaml:"maxBodyBytes"`
+}
+
+// A CacheRule sets the Cache-Control header of responses for paths that
+// match Match, a path.Match pattern. A pattern starting with "/", e.g.
+// "/static/*", is matched against the whole path; any other, e.g.
+// "*.css", against its last element.
+type CacheRule struct {
+	Match        string `yaml:"match"`
+	CacheControl string `yaml:"cacheControl"`
+}
+
+func (rule CacheRule) matches(urlPath string) bool {
+	name := urlPath
+	if !strings.HasPrefix(rule.Match, "/") {
+		name = path.Base(urlPath)
+	}
+	ok, _ := path.Match(rule.Match, name)
+	return ok
+}
+
+// withDefaults returns hs with the settings it leaves unset taken from
+// defaults. Error pages and headers are merged, those of hs winning, and
+// the cache rules of hs are tried before those of defaults.
+func (hs HostSettings) withDefaults(defaults HostSettings) HostSettings {
+	if hs.IndexFiles == nil {
+		hs.IndexFiles = defaults.IndexFiles
+	}
+	if hs.DirectoryListing == nil {
+		hs.DirectoryListing = defaults.DirectoryListing
+	}
+	hs.ErrorPages = mergeDefaults(defaults.ErrorPages, hs.ErrorPages)
+	hs.Headers = mergeDefaults(defaults.Headers, hs.Headers)
+	hs.CacheRules = append(append([]CacheRule(nil), hs.CacheRules...), defaults.CacheRules...)
+	if hs.AccessLog == "" {
+		hs.AccessLog = defaults.AccessLog
+	}
+	if hs.ReadTimeout == 0 {
+		hs.ReadTimeout = defaults.ReadTimeout
+	}
+	if hs.WriteTimeout == 0 {
+		hs.WriteTimeout = defaults.WriteTimeout
+	}
+	if hs.MaxBodyBytes == 0 {
+		hs.MaxBodyBytes = defaults.MaxBodyBytes
+	}
+	return hs
+}
+
+// mergeDefaults returns the entries of m together with those of defaults
+// whose key m lacks.
+func mergeDefaults[K comparable, V any](defaults, m map[K]V) map[K]V {
+	if len(defaults) == 0 {
+		return m
+	}
+	merged := maps.Clone(defaults)
+	maps.Copy(merged, m)
+	return merged
+}
+
+// hostSettings returns the middleware that applies the settings of the
+// virtual host vh to the responses of its handler.
+func (s *Server) hostSettings(vh hostMatch) []Middleware {
+	var mws []Middleware
+	if vh.host.AccessLog != "" {
+		mws = append(mws, Logging(s.accessLog(vh.host.AccessLog)))
+	}
+	if len(vh.host.Headers) > 0 {
+		mws = append(mws, SetHeaders(vh.host.Headers))
+	}
+	if len(vh.host.CacheRules) > 0 {
+		mws = append(mws, cacheRules(vh.host.CacheRules))
+	}
+	if len(vh.host.ErrorPages) > 0 {
+		mws = append(mws, errorPages(vh.docRoot, vh.host.ErrorPages))
+	}
+	return mws
+}
+
+// cacheRules sets the Cache-Control header of successful responses whose
+// path matches one of rules, unless the handler has set one.
+func cacheRules(rules []CacheRule) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(res *Response, req *Request) {
+			next.ServeTritonHTTP(res, req)
+			if res.StatusCode != 200 && res.StatusCode != 206 && res.StatusCode != 304 {
+				return
+			}
+			if res.Headers == nil {
+				res.Headers = make(Header)
+			}
+			if res.Headers.Has("Cache-Control") {
+				return
+			}
+			for _, rule := range rules {
+				if rule.matches(req.Path) {
+					res.Headers.Set("Cache-Control", rule.CacheControl)
+					return
+				}
+			}
+		})
+	}
+}
+
+// errorPages sends the file that pages lists below docRoot for the status
+// of a response that has no body of its own.
+func errorPages(docRoot string, pages map[int]string) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(res *Response, req *Request) {
+			next.ServeTritonHTTP(res, req)
+			page, ok := pages[res.StatusCode]
+			if !ok || res.FilePath != "" || res.Body != nil {
+				return
+			}
+			filePath, ok := resolvePath(docRoot, page)
+			if !ok {
+				return
+			}
+			stats, err := os.Stat(filePath)
+			if err != nil || !stats.Mode().IsRegular() {
+				return
+			}
+			if res.Headers == nil {
+				res.Headers = make(Header)
+			}
+			res.FilePath = filePath
+			res.ranges = nil
+			res.Headers.Set("Content-Length", strconv.FormatInt(stats.Size(), 10))
+			res.Headers.Set("Content-Type", MIMETypeByExtension(filepath.Ext(filePath)))
+		})
+	}
+}
+
+// accessLog returns a logger that appends to the file at path, opening
+// it on first use. If the file cannot be opened, the standard logger is
+// used instead.
+func (s *Server) accessLog(path string) *log.Logger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if logger, ok := s.accessLogs[path]; ok {
+		return logger
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		log.Printf("could not open access log %s : %v", path, err)
+		return log.Default()
+	}
+	if s.accessLogs == nil {
+		s.accessLogs = make(map[string]*log.Logger)
+	}
+	logger := log.New(f, "", log.LstdFlags)
+	s.accessLogs[path] = logger
+	s.accessLogFiles = append(s.accessLogFiles, f)
+	return logger
+}
+
+func (s *Server) closeAccessLogsLocked() {
+	for _, f := range s.accessLogFiles {
+		f.Close()
+	}
+	s.accessLogs = nil
+	s.accessLogFiles = nil
+}
+
+func (s *Server) maxBodyBytes(vh *VirtualHost) int64 {
+	if vh != nil && vh.MaxBodyBytes > 0 {
+		return vh.MaxBodyBytes
+	}
+	if s.MaxBodyBytes > 0 {
+		return s.MaxBodyBytes
+	}
+	return DefaultMaxBodyBytes
+}
+
+func (s *Server) readTimeout(vh *VirtualHost) time.Duration {
+	if vh != nil && vh.ReadTimeout > 0 {
+		return vh.ReadTimeout
+	}
+	if s.ReadTimeout > 0 {
+		return s.ReadTimeout
+	}
+	return DefaultReadTimeout
+}
+
+func (s *Server) writeTimeout(vh *VirtualHost) time.Duration {
+	if vh != nil && vh.WriteTimeout > 0 {
+		return vh.WriteTimeout
+	}
+	return s.WriteTimeout
+}
+
+// deadline returns the time something taking at most timeout must be
+// done by, or no deadline if timeout is 0.
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
@@ -0,0 +1,88 @@
+package tritonhttp
+
+import (
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// A Middleware wraps a Handler with some cross-cutting behaviour, such as
+// logging or authentication, and returns the wrapped Handler.
+type Middleware func(next Handler) Handler
+
+// Chain wraps h in mws so that mws[0] is the outermost layer: it sees the
+// request first and the finished response last.
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Logging logs every request together with the status of its response and
+// how long the handler took. If logger is nil, the standard logger is used.
+func Logging(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(res *Response, req *Request) {
+			start := time.Now()
+			next.ServeTritonHTTP(res, req)
+			logger.Printf("%s %q %d %s %v", req.Host, req.Method+" "+req.URL+" "+req.Proto,
+				res.StatusCode, res.Headers.Get("Content-Length"), time.Since(start))
+		})
+	}
+}
+
+// Recover turns a panic in the wrapped handler into a 500 response, so one
+// bad request cannot take down the whole server.
+func Recover(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(res *Response, req *Request) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Printf("panic serving %s %s: %v\n%s", req.Method, req.URL, r, debug.Stack())
+					res.Headers = make(Header)
+					res.HandleInternalServerError()
+				}
+			}()
+			next.ServeTritonHTTP(res, req)
+		})
+	}
+}
+
+// SetHeaders adds headers to every response, overriding any header of the
+// same name set by the wrapped handler.
+func SetHeaders(headers map[string]string) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(res *Response, req *Request) {
+			next.ServeTritonHTTP(res, req)
+			if res.Headers == nil {
+				res.Headers = make(Header)
+			}
+			for key, value := range headers {
+				res.Headers.Set(key, value)
+			}
+		})
+	}
+}
+
+// BasicAuth only lets requests through whose Authorization header holds
+// HTTP Basic credentials accepted by check; all others get a 401 asking
+// for credentials for realm.
+func BasicAuth(realm string, check func(user, password string) bool) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(res *Response, req *Request) {
+			user, password, ok := req.BasicAuth()
+			if !ok || !check(user, password) {
+				res.HandleUnauthorized(realm)
+				return
+			}
+			next.ServeTritonHTTP(res, req)
+		})
+	}
+}
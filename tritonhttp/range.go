@@ -0,0 +1,204 @@
+package tritonhttp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRanges bounds how many ranges a single request may ask for, so that
+// a client cannot make the server assemble a huge multipart response out
+// of tiny or overlapping pieces. Requests over the limit get the whole file.
+const maxRanges = 32
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// byteRange is one satisfiable range of a file, already clamped to its size.
+type byteRange struct {
+	start, length int64
+}
+
+// contentRange returns the Content-Range header value for r.
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a "Range: bytes=..." header for a file of the given
+// size. It returns nil ranges if the header is malformed, which means it
+// must be ignored, and errRangeNotSatisfiable if it is well-formed but
+// none of its ranges overlap the file.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	specs, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+	var ranges []byteRange
+	count := 0
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue // empty list elements are allowed
+		}
+		if count++; count > maxRanges {
+			return nil, nil
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, nil
+		}
+		var r byteRange
+		if first == "" {
+			// suffix range: the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 || !isDigits(last) {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || !isDigits(first) {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || !isDigits(last) || end < start {
+					return nil, nil
+				}
+				end = min(end, size-1)
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	if len(ranges) == 0 {
+		return nil, errRangeNotSatisfiable
+	}
+	return ranges, nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// ifRangeMatches reports whether the If-Range header value still describes
+// the file, so that the Range header may be honoured. It holds either a
+// strong ETag or the exact Last-Modified date.
+func ifRangeMatches(ifRange string, etag string, modTime time.Time) bool {
+	ifRange = strings.TrimSpace(ifRange)
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etag != "" && !strings.HasPrefix(etag, "W/") && ifRange == etag
+	}
+	date, err := ParseHTTPTime(ifRange)
+	return err == nil && date.Equal(modTime.Truncate(time.Second))
+}
+
+// handleRange turns a 200 response for a file of the given size into a
+// 206 or 416 if req asks for part of it, and advertises range support.
+func (res *Response) handleRange(req *Request, size int64, etag string, modTime time.Time) {
+	res.Headers.Set("Accept-Ranges", "bytes")
+	header := req.Headers.Get("Range")
+	if !req.Headers.Has("Range") || req.Method != "GET" {
+		return
+	}
+	if req.Headers.Has("If-Range") && !ifRangeMatches(req.Headers.Get("If-Range"), etag, modTime) {
+		return // the client's copy is stale, so send all of the file
+	}
+	ranges, err := parseRange(header, size)
+	if err != nil {
+		res.HandleRangeNotSatisfiable(size)
+		return
+	}
+	if ranges == nil {
+		return
+	}
+
+	res.StatusCode = 206
+	res.StatusText = StatusText(206)
+	res.ranges = ranges
+	res.fileSize = size
+	if len(ranges) == 1 {
+		res.Headers.Set("Content-Range", ranges[0].contentRange(size))
+		res.Headers.Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+		return
+	}
+	res.rangeBoundary = randomBoundary()
+	res.rangeContentType = res.Headers.Get("Content-Type")
+	var length int64
+	for i, r := range ranges {
+		length += int64(len(res.partHeader(i))) + r.length
+	}
+	length += int64(len(res.closingBoundary()))
+	res.Headers.Set("Content-Type", "multipart/byteranges; boundary="+res.rangeBoundary)
+	res.Headers.Set("Content-Length", strconv.FormatInt(length, 10))
+}
+
+// partHeader returns the delimiter and headers that precede part i of a
+// multipart/byteranges body.
+func (res *Response) partHeader(i int) string {
+	delimiter := "--" + res.rangeBoundary + "\r\n"
+	if i > 0 {
+		delimiter = "\r\n" + delimiter
+	}
+	header := delimiter
+	if res.rangeContentType != "" {
+		header += "Content-Type: " + res.rangeContentType + "\r\n"
+	}
+	return header + "Content-Range: " + res.ranges[i].contentRange(res.fileSize) + "\r\n\r\n"
+}
+
+func (res *Response) closingBoundary() string {
+	return "\r\n--" + res.rangeBoundary + "--\r\n"
+}
+
+// writeRanges writes the ranges of file that res selected. A single range
+// is copied straight to w so that sendfile can still be used.
+func (res *Response) writeRanges(w io.Writer, file *os.File) error {
+	if len(res.ranges) == 1 {
+		r := res.ranges[0]
+		if _, err := file.Seek(r.start, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.CopyN(w, file, r.length)
+		return err
+	}
+	for i, r := range res.ranges {
+		if _, err := io.WriteString(w, res.partHeader(i)); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(file, r.start, r.length)); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, res.closingBoundary())
+	return err
+}
+
+func randomBoundary() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
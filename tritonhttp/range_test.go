@@ -0,0 +1,118 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		ranges []byteRange
+		err    error
+	}{
+		{"bytes=0-4", []byteRange{{0, 5}}, nil},
+		{"bytes=5-", []byteRange{{5, 5}}, nil},
+		{"bytes=-3", []byteRange{{7, 3}}, nil},
+		{"bytes=-30", []byteRange{{0, 10}}, nil},
+		{"bytes=8-100", []byteRange{{8, 2}}, nil},
+		{"bytes=0-0, -1", []byteRange{{0, 1}, {9, 1}}, nil},
+		{"bytes=20-30, 2-3", []byteRange{{2, 2}}, nil},
+		{"bytes=10-", nil, errRangeNotSatisfiable},
+		{"bytes=-0", nil, errRangeNotSatisfiable},
+		{"bytes=4-2", nil, nil},
+		{"bytes=a-b", nil, nil},
+		{"bytes=+1-2", nil, nil},
+		{"bytes=", nil, nil},
+		{"lines=0-4", nil, nil},
+	}
+	for _, tt := range tests {
+		ranges, err := parseRange(tt.header, 10)
+		if !reflect.DeepEqual(ranges, tt.ranges) || err != tt.err {
+			t.Errorf("parseRange(%q) = %v, %v; want %v, %v", tt.header, ranges, err, tt.ranges, tt.err)
+		}
+	}
+}
+
+// serveRange serves /a.txt from docRoot for a GET with the given headers
+// and parses the written response.
+func serveRange(t *testing.T, docRoot string, headers Header) *http.Response {
+	req := &Request{Method: "GET", URL: "/a.txt", Path: "/a.txt", Proto: "HTTP/1.1", Headers: headers}
+	res := &Response{}
+	res.HandleFile(docRoot, req, nil)
+	var buf bytes.Buffer
+	if err := res.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	return resp
+}
+
+func TestHandleFileRanges(t *testing.T) {
+	docRoot := t.TempDir()
+	if err := os.WriteFile(filepath.Join(docRoot, "a.txt"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Whole file
+	resp := serveRange(t, docRoot, Header{})
+	if resp.StatusCode != 200 || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("Expected 200 with Accept-Ranges but got %v %v", resp.StatusCode, resp.Header)
+	}
+	etag := resp.Header.Get("Etag")
+
+	// Single range
+	resp = serveRange(t, docRoot, Header{"Range": {"bytes=2-5"}})
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 206 || string(body) != "2345" || resp.Header.Get("Content-Range") != "bytes 2-5/10" {
+		t.Fatalf("Expected 206 \"2345\" but got %v %q %v", resp.StatusCode, body, resp.Header)
+	}
+
+	// Multiple ranges
+	resp = serveRange(t, docRoot, Header{"Range": {"bytes=0-1,-2"}})
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != 206 || err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Expected a 206 multipart/byteranges response but got %v %v", resp.StatusCode, resp.Header)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for _, want := range []struct{ body, contentRange string }{{"01", "bytes 0-1/10"}, {"89", "bytes 8-9/10"}} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("Error reading part: %v", err)
+		}
+		body, _ := io.ReadAll(part)
+		if string(body) != want.body || part.Header.Get("Content-Range") != want.contentRange {
+			t.Fatalf("Expected part %q (%v) but got %q (%v)", want.body, want.contentRange, body, part.Header.Get("Content-Range"))
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Fatalf("Expected exactly two parts, got %v", err)
+	}
+
+	// Unsatisfiable
+	resp = serveRange(t, docRoot, Header{"Range": {"bytes=20-"}})
+	if resp.StatusCode != 416 || resp.Header.Get("Content-Range") != "bytes */10" {
+		t.Fatalf("Expected 416 but got %v %v", resp.StatusCode, resp.Header)
+	}
+
+	// If-Range
+	resp = serveRange(t, docRoot, Header{"Range": {"bytes=2-5"}, "If-Range": {etag}})
+	if resp.StatusCode != 206 {
+		t.Fatalf("Expected 206 for a matching If-Range but got %v", resp.StatusCode)
+	}
+	resp = serveRange(t, docRoot, Header{"Range": {"bytes=2-5"}, "If-Range": {`"stale"`}})
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected 200 for a stale If-Range but got %v", resp.StatusCode)
+	}
+}
@@ -1,13 +1,68 @@
 package tritonhttp
 
+import (
+	"encoding/base64"
+	"io"
+	"mime/multipart"
+	"net/url"
+	"strings"
+)
+
 type Request struct {
 	Method string // e.g. "GET"
-	URL    string // e.g. "/path/to/a/file"
+	URL    string // e.g. "/path/to/a%20file?v=2" or "http://website1/", the request-target as sent
 	Proto  string // e.g. "HTTP/1.1"
 
-	// Headers stores the key-value HTTP headers
-	Headers map[string]string
+	Path     string     // e.g. "/path/to/a file", the percent-decoded path of URL, or "*" for OPTIONS *
+	RawQuery string     // e.g. "v=2", the query of URL without the "?"
+	Query    url.Values // the parsed RawQuery
+
+	// Headers stores the HTTP headers, keyed by canonical field name
+	Headers Header
 
 	Host  string // determine from the "Host" header
 	Close bool   // determine from the "Connection" header
+
+	// Body reads the request body, decoding a chunked body if needed. It
+	// is never nil; a request without a body reads as empty. Whatever the
+	// handler leaves unread is discarded before the next request.
+	Body io.Reader
+
+	// ContentLength is the length of the body, or -1 if it is chunked.
+	ContentLength int64
+
+	// Trailers holds the trailer fields of a chunked body once Body has
+	// been read to the end.
+	Trailers Header
+
+	// Form holds the parsed form fields, and PostForm the ones that came
+	// from the request body. Both are nil until ParseForm is called.
+	Form     url.Values
+	PostForm url.Values
+
+	// MultipartForm holds the parsed multipart/form-data body, including
+	// uploaded files. It is nil until ParseMultipartForm is called.
+	MultipartForm *multipart.Form
+
+	// expectContinue is set if the client waits for a 100 Continue
+	// response before sending the body (Expect: 100-continue).
+	expectContinue bool
+
+	// targetHost is the authority from an absolute-form or authority-form
+	// request-target, which takes precedence over the Host header.
+	targetHost string
+}
+
+// BasicAuth returns the user name and password from the request's
+// Authorization header, if it uses HTTP Basic authentication.
+func (req *Request) BasicAuth() (user, password string, ok bool) {
+	scheme, credentials, found := strings.Cut(req.Headers.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
 }
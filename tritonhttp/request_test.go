@@ -0,0 +1,410 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReadRequestBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      string
+		body     string
+		length   int64
+		trailers Header
+	}{
+		{"none", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", "", 0, nil},
+		{"content-length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello", "hello", 5, nil},
+		{"chunked", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5\r\nhello\r\n7;ext=1\r\n, world\r\n0\r\n\r\n", "hello, world", -1, nil},
+		{"chunked trailers", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"3\r\nabc\r\n0\r\nChecksum: 123\r\n\r\n", "abc", -1, Header{"Checksum": {"123"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A second request follows, to check the body is framed exactly
+			br := bufio.NewReader(strings.NewReader(tt.req + "GET /next HTTP/1.1\r\nHost: a\r\n\r\n"))
+			req, err, _ := ReadRequest(br)
+			if err != nil {
+				t.Fatalf("ReadRequest: %v", err)
+			}
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Fatalf("Error reading body: %v", err)
+			}
+			if string(body) != tt.body || req.ContentLength != tt.length {
+				t.Fatalf("Expected body %q of length %v but got %q of length %v", tt.body, tt.length, body, req.ContentLength)
+			}
+			for key, values := range tt.trailers {
+				if req.Trailers.Get(key) != values[0] {
+					t.Fatalf("Expected trailer %v: %v but got %v", key, values[0], req.Trailers)
+				}
+			}
+			next, err, _ := ReadRequest(br)
+			if err != nil || next.URL != "/next" {
+				t.Fatalf("Expected the next request to follow the body, got %v, %v", next, err)
+			}
+		})
+	}
+}
+
+func TestReadRequestBadBody(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+	}{
+		{"negative length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -1\r\n\r\n"},
+		{"signed length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +1\r\n\r\nx"},
+		{"bad length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: five\r\n\r\n"},
+		{"unknown coding", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err, _ := ReadRequest(bufio.NewReader(strings.NewReader(tt.req))); err == nil {
+				t.Fatal("Expected an error")
+			}
+		})
+	}
+
+	// Malformed chunks only show up while reading the body
+	for _, chunks := range []string{"z\r\nabc\r\n0\r\n\r\n", "3\r\nabcd\r\n0\r\n\r\n", "3\r\nab"} {
+		br := bufio.NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" + chunks))
+		req, err, _ := ReadRequest(br)
+		if err != nil {
+			t.Fatalf("ReadRequest: %v", err)
+		}
+		if _, err := io.ReadAll(req.Body); err == nil {
+			t.Fatalf("Expected an error reading chunks %q", chunks)
+		}
+	}
+}
+
+func TestMaxBytesReader(t *testing.T) {
+	for _, tt := range []struct {
+		body string
+		err  error
+	}{{"12345", nil}, {"123456", ErrBodyTooLarge}} {
+		mr := &maxBytesReader{r: strings.NewReader(tt.body), n: 5}
+		got, err := io.ReadAll(mr)
+		if err != tt.err || len(got) > 5 || mr.exceeded != (tt.err != nil) {
+			t.Errorf("reading %q with a limit of 5 = %q, %v; want error %v", tt.body, got, err, tt.err)
+		}
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		path   string
+		query  string
+		ok     bool
+	}{
+		{"/index.html", "/index.html", "", true},
+		{"/my%20file.html", "/my file.html", "", true},
+		{"/index.html?v=2&tag=a%20b", "/index.html", "v=2&tag=a%20b", true},
+		{"/caf%C3%A9/", "/café/", "", true},
+		{"/a%2Fb", "", "", false},
+		{"/a%2fb", "", "", false},
+		{"/a%00.html", "", "", false},
+		{"/a%zz", "", "", false},
+		{"/a#frag", "", "", false},
+	}
+	for _, tt := range tests {
+		req := &Request{URL: tt.target}
+		err := parseTarget(req)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseTarget(%q) error = %v; want ok = %v", tt.target, err, tt.ok)
+			continue
+		}
+		if tt.ok && (req.Path != tt.path || req.RawQuery != tt.query) {
+			t.Errorf("parseTarget(%q) = %q, %q; want %q, %q", tt.target, req.Path, req.RawQuery, tt.path, tt.query)
+		}
+	}
+
+	req := &Request{URL: "/search?q=triton&q=http&page=2"}
+	if err := parseTarget(req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Query.Get("page") != "2" || len(req.Query["q"]) != 2 {
+		t.Fatalf("Unexpected query %v", req.Query)
+	}
+}
+
+func TestReadRequestTargetForms(t *testing.T) {
+	tests := []struct {
+		line string
+		host string
+		path string
+		ok   bool
+	}{
+		{"GET /index.html HTTP/1.1", "website1", "/index.html", true},
+		{"GET http://website2/index.html?v=1 HTTP/1.1", "website2", "/index.html", true},
+		{"GET HTTP://website2:8080 HTTP/1.1", "website2", "/", true},
+		{"GET http://website2?v=1 HTTP/1.1", "website2", "/", true},
+		{"OPTIONS * HTTP/1.1", "website1", "*", true},
+		{"CONNECT website2:443 HTTP/1.1", "website2", "", true},
+		{"GET * HTTP/1.1", "", "", false},
+		{"GET website2:443 HTTP/1.1", "", "", false},
+		{"CONNECT website2 HTTP/1.1", "", "", false},
+		{"GET ftp://website2/ HTTP/1.1", "", "", false},
+		{"GET http:///index.html HTTP/1.1", "", "", false},
+		{"GET http://user@website2/ HTTP/1.1", "", "", false},
+		{"GET index.html HTTP/1.1", "", "", false},
+	}
+	for _, tt := range tests {
+		br := bufio.NewReader(strings.NewReader(tt.line + "\r\nHost: website1\r\n\r\n"))
+		req, err, _ := ReadRequest(br)
+		if (err == nil) != tt.ok {
+			t.Errorf("ReadRequest(%q) error = %v; want ok = %v", tt.line, err, tt.ok)
+			continue
+		}
+		if tt.ok && (req.Host != tt.host || req.Path != tt.path) {
+			t.Errorf("ReadRequest(%q) host, path = %q, %q; want %q, %q", tt.line, req.Host, req.Path, tt.host, tt.path)
+		}
+	}
+}
+
+func TestReadRequestStrict(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     string
+		lenient bool // whether ReadRequest accepts it by default
+	}{
+		{"bare LF", "GET / HTTP/1.1\nHost: a\n\n", true},
+		{"bare CR", "GET / HTTP/1.1\r\nHost: a\r\nX-A: b\rX-Smuggled: 1\r\n\r\n", true},
+		{"space before colon", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length : 3\r\n\r\nabc", true},
+		{"invalid name", "GET / HTTP/1.1\r\nHost: a\r\nX[1]: b\r\n\r\n", true},
+		{"control character in value", "GET / HTTP/1.1\r\nHost: a\r\nX-A: b\x00c\r\n\r\n", true},
+		{"space in target", "GET /a b HTTP/1.1\r\nHost: a\r\n\r\n", false},
+		{"double space", "GET  / HTTP/1.1\r\nHost: a\r\n\r\n", false},
+		{"obs-fold", "GET / HTTP/1.1\r\nHost: a\r\nX-A: b\r\n Content-Length: 3\r\n\r\nabc", false},
+		{"repeated length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nabc", true},
+		{"length list", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3, 3\r\n\r\nabc", true},
+		{"conflicting lengths", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\nabcd", false},
+		{"length and chunked", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", true},
+		{"chunked twice", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err, _ := readRequest(bufio.NewReader(strings.NewReader(tt.req)), &parseOptions{strict: true}); err == nil {
+				t.Fatal("Expected an error in strict mode")
+			}
+			if _, err, _ := ReadRequest(bufio.NewReader(strings.NewReader(tt.req))); (err == nil) != tt.lenient {
+				t.Fatalf("ReadRequest error = %v; want ok = %v", err, tt.lenient)
+			}
+		})
+	}
+
+	// A request framed both ways is read as chunked, on a connection that
+	// is then closed
+	both := "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"
+	req, err, _ := ReadRequest(bufio.NewReader(strings.NewReader(both)))
+	if err != nil || req.ContentLength != -1 || !req.Close || req.Headers.Has("Content-Length") {
+		t.Fatalf("Expected a chunked request that closes the connection but got %v, %+v", err, req)
+	}
+
+	// Bare LF is rejected inside a chunked body too
+	br := bufio.NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\nabc\r\n0\r\n\r\n"))
+	req, err, _ = readRequest(br, &parseOptions{strict: true})
+	if err != nil {
+		t.Fatalf("readRequest: %v", err)
+	}
+	if _, err := io.ReadAll(req.Body); err == nil {
+		t.Fatal("Expected an error reading a chunk-size line ending in bare LF")
+	}
+}
+
+// FuzzReadRequest checks that no input makes the parser panic, and that
+// a request accepted in strict mode is framed the same way by the
+// default mode and by net/http, so that the body ends at the same byte
+// whichever server reads it.
+func FuzzReadRequest(f *testing.F) {
+	for _, seed := range []string{
+		"GET / HTTP/1.1\r\nHost: a\r\n\r\n",
+		"GET / HTTP/1.1\nHost: a\n\n",
+		"GET http://a/?x=1 HTTP/1.1\r\nHost: b\r\n\r\n",
+		"OPTIONS * HTTP/1.1\r\nHost: a\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhelloGET / HTTP/1.1\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;x=1\r\nhello\r\n0\r\nX-Sum: 1\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\nabcd",
+		"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3, 3\r\n\r\nabc",
+		"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: identity\r\n\r\n0\r\n\r\n",
+		"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding : chunked\r\nContent-Length: 3\r\n\r\nabc",
+		"POST / HTTP/1.1\r\nHost: a\r\nX: y\r\n Content-Length: 3\r\n\r\nabc",
+		"POST / HTTP/1.1\r\nHost: a\rContent-Length: 3\r\n\r\nabc",
+		"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +3\r\n\r\nabc",
+		"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nffffffffffffffff\r\n",
+		"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\nabc\n0\n\n",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data string) {
+		body, rest, ok := readFramed(data, &parseOptions{strict: true})
+		if !ok {
+			// Only check that the default mode does not panic
+			readFramed(data, &parseOptions{})
+			return
+		}
+		lenientBody, lenientRest, ok := readFramed(data, &parseOptions{})
+		if !ok || lenientBody != body || lenientRest != rest {
+			t.Fatalf("Default mode framed %q as %q then %q, strict mode as %q then %q",
+				data, lenientBody, lenientRest, body, rest)
+		}
+		br := bufio.NewReader(strings.NewReader(data))
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		goBody, err := io.ReadAll(req.Body)
+		if err != nil {
+			return
+		}
+		goRest, _ := io.ReadAll(br)
+		if !bytes.Equal(goBody, []byte(body)) || string(goRest) != rest {
+			t.Fatalf("net/http framed %q as %q then %q, strict mode as %q then %q",
+				data, goBody, goRest, body, rest)
+		}
+	})
+}
+
+// readFramed parses data as a request and returns its body and whatever
+// follows it, or ok = false if the request or its body is malformed.
+func readFramed(data string, opts *parseOptions) (body, rest string, ok bool) {
+	br := bufio.NewReader(strings.NewReader(data))
+	req, err, _ := readRequest(br, opts)
+	if err != nil {
+		return "", "", false
+	}
+	b, err := io.ReadAll(req.Body)
+	if err != nil || (req.ContentLength >= 0 && int64(len(b)) != req.ContentLength) {
+		return "", "", false
+	}
+	r, _ := io.ReadAll(br)
+	return string(b), string(r), true
+}
+
+func TestReadRequestLimits(t *testing.T) {
+	opts := &parseOptions{maxRequestLine: 32, maxHeaderBytes: 64, maxHeaderFields: 3}
+	tests := []struct {
+		name   string
+		req    string
+		status int // 0 if the request is valid
+	}{
+		{"within limits", "GET /abc HTTP/1.1\r\nHost: a\r\nX-A: 1\r\nX-B: 2\r\n\r\n", 0},
+		{"long request line", "GET /" + strings.Repeat("a", 32) + " HTTP/1.1\r\nHost: a\r\n\r\n", 414},
+		{"long header", "GET / HTTP/1.1\r\nHost: a\r\nX-A: " + strings.Repeat("a", 64) + "\r\n\r\n", 431},
+		{"long header section", "GET / HTTP/1.1\r\nHost: a\r\nX-A: " + strings.Repeat("a", 20) +
+			"\r\nX-B: " + strings.Repeat("b", 20) + "\r\n\r\n", 431},
+		{"too many headers", "GET / HTTP/1.1\r\nHost: a\r\nX-A: 1\r\nX-B: 2\r\nX-C: 3\r\n\r\n", 431},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err, isEOF := readRequest(bufio.NewReader(strings.NewReader(tt.req)), opts)
+			if tt.status == 0 {
+				if err != nil {
+					t.Fatalf("readRequest: %v", err)
+				}
+				return
+			}
+			se, ok := err.(*statusError)
+			if !ok || se.code != tt.status || isEOF {
+				t.Fatalf("Expected a %v error but got %v (isEOF %v)", tt.status, err, isEOF)
+			}
+		})
+	}
+
+	// A line longer than the bufio buffer is still read whole when it fits
+	long := "GET / HTTP/1.1\r\nHost: a\r\nX-A: " + strings.Repeat("a", 10000) + "\r\n\r\n"
+	req, err, _ := ReadRequest(bufio.NewReaderSize(strings.NewReader(long), 16))
+	if err != nil || len(req.Headers.Get("X-A")) != 10000 {
+		t.Fatalf("Expected a 10000 byte header but got %v", err)
+	}
+}
+
+func TestReadRequestVersions(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    string
+		close  bool
+		status int // of the error, or 0 if the request is valid
+	}{
+		{"1.1", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", false, 0},
+		{"1.1 close", "GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n", true, 0},
+		{"1.0", "GET / HTTP/1.0\r\n\r\n", true, 0},
+		{"1.0 keep-alive", "GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n", false, 0},
+		{"1.0 body", "POST / HTTP/1.0\r\nContent-Length: 2\r\n\r\nhi", true, 0},
+		{"1.0 chunked", "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", false, 400},
+		{"2.0", "GET / HTTP/2.0\r\nHost: a\r\n\r\n", false, 505},
+		{"0.9", "GET / HTTP/0.9\r\nHost: a\r\n\r\n", false, 505},
+		{"malformed", "GET / HTTP/1\r\nHost: a\r\n\r\n", false, 400},
+		{"lowercase", "GET / http/1.1\r\nHost: a\r\n\r\n", false, 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err, _ := ReadRequest(bufio.NewReader(strings.NewReader(tt.req)))
+			switch {
+			case tt.status == 0:
+				if err != nil {
+					t.Fatalf("ReadRequest: %v", err)
+				}
+				if req.Close != tt.close {
+					t.Fatalf("Expected Close = %v but got %v", tt.close, req.Close)
+				}
+			case tt.status == 400:
+				if _, ok := err.(*statusError); err == nil || ok {
+					t.Fatalf("Expected a plain error but got %v", err)
+				}
+			default:
+				if se, ok := err.(*statusError); !ok || se.code != tt.status {
+					t.Fatalf("Expected a %v error but got %v", tt.status, err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseHost(t *testing.T) {
+	tests := []struct {
+		in   string
+		host string
+		ok   bool
+	}{
+		{"website1", "website1", true},
+		{"WebSite1:8080", "website1", true},
+		{"website1:", "website1", true},
+		{"127.0.0.1:80", "127.0.0.1", true},
+		{"[::1]", "[::1]", true},
+		{"[0:0:0:0:0:0:0:1]:8080", "[::1]", true},
+		{"[FE80::1]", "[fe80::1]", true},
+		{"", "", false},
+		{":8080", "", false},
+		{"website1:http", "", false},
+		{"web site", "", false},
+		{"website1/index.html", "", false},
+		{"[::1", "", false},
+		{"[127.0.0.1]", "", false},
+		{"[::1]x", "", false},
+		{"::1", "", false},
+	}
+	for _, tt := range tests {
+		host, err := parseHost(tt.in)
+		if (err == nil) != tt.ok || host != tt.host {
+			t.Errorf("parseHost(%q) = %q, %v; want %q, ok = %v", tt.in, host, err, tt.host, tt.ok)
+		}
+	}
+
+	for _, req := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n",
+		"GET http://a/ HTTP/1.1\r\n\r\n",
+	} {
+		if _, err, _ := ReadRequest(bufio.NewReader(strings.NewReader(req))); err == nil {
+			t.Errorf("ReadRequest(%q) should fail without exactly one Host header", req)
+		}
+	}
+}
@@ -2,11 +2,13 @@ package tritonhttp
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"html"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,8 +19,9 @@ type Response struct {
 	StatusCode int    // e.g. 200
 	StatusText string // e.g. "OK"
 
-	// Headers stores all headers to write to the response.
-	Headers map[string]string
+	// Headers stores all headers to write to the response. A field with
+	// several values is written on several lines.
+	Headers Header
 
 	// Request is the valid request that leads to this response.
 	// It could be nil for responses not resulting from a valid request.
@@ -28,6 +31,76 @@ type Response struct {
 	// FilePath is the local path to the file to serve.
 	// It could be "", which means there is no file to serve.
 	FilePath string
+
+	// Body is sent after the headers when FilePath is "". Handlers that
+	// generate content use it instead of FilePath. If the Content-Length
+	// header is not set and Body has no Len method, Body is sent with
+	// chunked transfer encoding, or, for clients that do not speak
+	// HTTP/1.1, the connection is closed after it to mark where it ends.
+	Body io.Reader
+
+	// Trailers are sent after a chunked Body. The keys must be set before
+	// the response is written, since they are announced in the Trailer
+	// header; the values may be filled in while Body is being read.
+	Trailers Header
+
+	// ranges are the parts of FilePath to send for a 206 response, and
+	// the details needed to frame them when there is more than one.
+	ranges           []byteRange
+	fileSize         int64
+	rangeBoundary    string
+	rangeContentType string
+}
+
+// statusText maps the status codes the server can send to their reason phrases.
+var statusText = map[int]string{
+	100: "Continue",
+	200: "OK",
+	201: "Created",
+	204: "No Content",
+	206: "Partial Content",
+	207: "Multi-Status",
+	301: "Moved Permanently",
+	304: "Not Modified",
+	400: "Bad Request",
+	401: "Unauthorized",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	409: "Conflict",
+	412: "Precondition Failed",
+	413: "Payload Too Large",
+	414: "URI Too Long",
+	415: "Unsupported Media Type",
+	416: "Range Not Satisfiable",
+	417: "Expectation Failed",
+	421: "Misdirected Request",
+	431: "Request Header Fields Too Large",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	505: "HTTP Version Not Supported",
+}
+
+// StatusText returns the reason phrase for code, or "" if it is unknown.
+func StatusText(code int) string {
+	return statusText[code]
+}
+
+// HandleStatus sets up a response with the given status code and a Date
+// header, leaving the body empty. Handlers use it for responses that
+// have no dedicated helper below.
+func (res *Response) HandleStatus(code int) {
+	res.Proto = "HTTP/1.1"
+	res.StatusCode = code
+	res.StatusText = StatusText(code)
+	if res.Headers == nil {
+		res.Headers = make(Header)
+	}
+	res.Headers.Set("Date", FormatTime(time.Now()))
+	res.FilePath = ""
+	res.Body = nil
+	res.ranges = nil
 }
 
 func (res *Response) HandleBadRequest() {
@@ -35,11 +108,12 @@ func (res *Response) HandleBadRequest() {
 	res.StatusCode = 400
 	res.StatusText = "Bad Request"
 	if res.Headers == nil {
-		res.Headers = make(map[string]string)
+		res.Headers = make(Header)
 	}
-	res.Headers["Connection"] = "close"
-	res.Headers["Date"] = FormatTime(time.Now())
+	res.Headers.Set("Connection", "close")
+	res.Headers.Set("Date", FormatTime(time.Now()))
 	res.FilePath = ""
+	res.Body = nil
 }
 
 func (res *Response) HandleStatusNotFound() {
@@ -47,35 +121,140 @@ func (res *Response) HandleStatusNotFound() {
 	res.StatusCode = 404
 	res.StatusText = "Not Found"
 	if res.Headers == nil {
-		res.Headers = make(map[string]string)
+		res.Headers = make(Header)
 	}
-	res.Headers["Date"] = FormatTime(time.Now())
+	res.Headers.Set("Date", FormatTime(time.Now()))
 	res.FilePath = ""
+	res.Body = nil
+}
+
+// HandleCreated answers a request that created a new resource.
+func (res *Response) HandleCreated() {
+	res.HandleStatus(201)
+}
+
+// HandleForbidden answers a request the server refuses to carry out,
+// such as deleting the docRoot itself.
+func (res *Response) HandleForbidden() {
+	res.HandleStatus(403)
+}
+
+// HandleConflict answers a request that cannot be carried out in the
+// current state of the docRoot, such as writing below a missing directory.
+func (res *Response) HandleConflict() {
+	res.HandleStatus(409)
+}
+
+// HandleNotModified turns a 200 response for a file into a 304, keeping
+// its validators (such as Last-Modified) but dropping the body.
+func (res *Response) HandleNotModified() {
+	res.HandleStatus(304)
+	res.Headers.Del("Content-Length")
+	res.Headers.Del("Content-Type")
+}
+
+// HandlePreconditionFailed answers a request whose If-Match or
+// If-Unmodified-Since condition does not hold for the file.
+func (res *Response) HandlePreconditionFailed() {
+	res.HandleStatus(412)
+	res.Headers.Del("Content-Length")
+	res.Headers.Del("Content-Type")
+}
+
+// HandleRangeNotSatisfiable answers a request for byte ranges that all
+// lie beyond the end of a file of the given size.
+func (res *Response) HandleRangeNotSatisfiable(size int64) {
+	res.HandleStatus(416)
+	res.Headers.Del("Content-Type")
+	res.Headers.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	res.Headers.Set("Content-Length", "0")
+}
+
+// HandlePayloadTooLarge answers a request whose body is larger than the
+// server allows. The connection is closed, since the rest of the body
+// is not read.
+func (res *Response) HandlePayloadTooLarge() {
+	res.HandleStatus(413)
+	res.Headers.Set("Connection", "close")
+}
+
+// HandleMovedPermanently redirects the client to location for good.
+func (res *Response) HandleMovedPermanently(location string) {
+	res.HandleStatus(301)
+	res.Headers.Set("Location", location)
+}
+
+// HandleMisdirectedRequest answers a request for a host that the server
+// does not serve.
+func (res *Response) HandleMisdirectedRequest() {
+	res.HandleStatus(421)
+}
+
+// HandleMethodNotAllowed answers a request whose method the resource does
+// not support. allow lists the methods it does support.
+func (res *Response) HandleMethodNotAllowed(allow ...string) {
+	res.HandleStatus(405)
+	res.Headers.Set("Allow", strings.Join(allow, ", "))
+}
+
+// HandleNotImplemented answers a request whose method the server does not
+// recognise at all.
+func (res *Response) HandleNotImplemented() {
+	res.HandleStatus(501)
+}
+
+func (res *Response) HandleUnauthorized(realm string) {
+	res.HandleStatus(401)
+	res.Headers.Set("Www-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+}
 
+func (res *Response) HandleInternalServerError() {
+	res.HandleStatus(500)
 }
 
+// HandleOK serves the file that req names under docRoot with the default
+// FileOptions.
 func (res *Response) HandleOK(docRoot string, req *Request) {
+	res.HandleFile(docRoot, req, nil)
+}
+
+// HandleFile serves the file that req names under docRoot, answering
+// conditional requests as configured by opts. A nil opts means the
+// default FileOptions.
+func (res *Response) HandleFile(docRoot string, req *Request, opts *FileOptions) {
+	if opts == nil {
+		opts = &FileOptions{}
+	}
 	res.Request = req
 	res.Proto = "HTTP/1.1"
 	res.StatusCode = 200
 	res.StatusText = "OK"
 	if res.Headers == nil {
-		res.Headers = make(map[string]string)
+		res.Headers = make(Header)
 	}
-	res.Headers["Date"] = FormatTime(time.Now())
-	res.FilePath = docRoot + res.Request.URL
-	if res.Request.URL[len(res.Request.URL)-1] == '/' {
-		res.FilePath += "index.html"
-	}
-	fmt.Println("File Path: ", res.FilePath)
+	res.Headers.Set("Date", FormatTime(time.Now()))
+	res.Body = nil
 	// prevent directory traversal
-	res.FilePath = filepath.Clean(res.FilePath) // clean the path, remove any ".." or "." from the path
-	fmt.Println("Cleaned File Path: ", res.FilePath)
-	if !strings.HasPrefix(res.FilePath, docRoot) {
+	filePath, ok := resolvePath(docRoot, res.Request.Path)
+	if !ok {
 		fmt.Println("Directory Traversal Detected")
 		res.HandleStatusNotFound()
 		return
 	}
+	if strings.HasSuffix(res.Request.Path, "/") {
+		dir := filePath
+		filePath = indexFile(dir, opts.indexFiles())
+		if filePath == "" && opts.DirectoryListing {
+			res.handleDirectoryListing(dir, req)
+			return
+		}
+		if filePath == "" {
+			res.HandleStatusNotFound()
+			return
+		}
+	}
+	res.FilePath = filePath
+	fmt.Println("File Path: ", res.FilePath)
 
 	if _, err := os.Stat(res.FilePath); os.IsNotExist(err) {
 		fmt.Println("File does not exist")
@@ -94,13 +273,111 @@ func (res *Response) HandleOK(docRoot string, req *Request) {
 		res.HandleStatusNotFound()
 		return
 	}
-	res.Headers["Content-Length"] = strconv.FormatInt(stats.Size(), 10)
-	res.Headers["Content-Type"] = MIMETypeByExtension(filepath.Ext(res.FilePath))
-	res.Headers["Date"] = FormatTime(time.Now())
-	res.Headers["Last-Modified"] = FormatTime(stats.ModTime())
+	res.Headers.Set("Content-Length", strconv.FormatInt(stats.Size(), 10))
+	res.Headers.Set("Content-Type", MIMETypeByExtension(filepath.Ext(res.FilePath)))
+	res.Headers.Set("Date", FormatTime(time.Now()))
+	res.Headers.Set("Last-Modified", FormatTime(stats.ModTime()))
+	etag := fileETag(res.FilePath, stats, opts)
+	if etag != "" {
+		res.Headers.Set("Etag", etag)
+	}
+
+	if res.checkPreconditions(req, etag, stats.ModTime()) {
+		return
+	}
+	res.handleRange(req, stats.Size(), etag, stats.ModTime())
+}
+
+// indexFile returns the path of the first of names that is a file in
+// dir, or "" if there is none.
+func indexFile(dir string, names []string) string {
+	for _, name := range names {
+		filePath := filepath.Join(dir, filepath.FromSlash(name))
+		if stats, err := os.Stat(filePath); err == nil && stats.Mode().IsRegular() {
+			return filePath
+		}
+	}
+	return ""
 }
 
+// handleDirectoryListing answers req, which names the directory dir,
+// with an HTML page linking to its entries.
+func (res *Response) handleDirectoryListing(dir string, req *Request) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		res.HandleStatusNotFound()
+		return
+	}
+	title := html.EscapeString("Index of " + req.Path)
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "<!DOCTYPE html>\n<html>\n<head><title>%s</title></head>\n<body>\n<h1>%s</h1>\n<ul>\n", title, title)
+	for _, entry := range entries { // sorted by name
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		// "./" keeps a name like "a:b" from being read as a URL scheme
+		href := "./" + (&url.URL{Path: name}).EscapedPath()
+		fmt.Fprintf(&body, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	body.WriteString("</ul>\n</body>\n</html>\n")
+	res.HandleStatus(200)
+	res.Headers.Set("Content-Type", "text/html; charset=utf-8")
+	res.Body = &body
+}
+
+// resolvePath maps the decoded urlPath onto a path below docRoot. filepath.Join
+// cleans the result, removing any ".." or "." elements, so it reports
+// false if the path would escape docRoot.
+func resolvePath(docRoot string, urlPath string) (string, bool) {
+	if docRoot == "" {
+		return "", false // unknown host
+	}
+	root := filepath.Clean(docRoot)
+	path := filepath.Join(root, filepath.FromSlash(urlPath))
+	if path != root && !strings.HasPrefix(path, root+string(filepath.Separator)) {
+		return "", false
+	}
+	return path, true
+}
+
+// Write writes res to w. An informational (1xx) response is written as
+// an interim response: just the status line and headers, which the final
+// response follows later on the same connection.
 func (res *Response) Write(w io.Writer) error {
+	if res.FilePath == "" {
+		res.frameBody()
+	}
+	// A HEAD response carries the same headers as a GET, but no body
+	sendBody := bodyAllowed(res.StatusCode) && (res.Request == nil || res.Request.Method != "HEAD")
+
+	// Open the file before writing the status line, so that a file that
+	// vanished since HandleOK is reported as an error instead of leaving
+	// the client with a truncated response
+	var file *os.File
+	needLength := bodyAllowed(res.StatusCode) && !res.Headers.Has("Content-Length")
+	if len(res.FilePath) > 0 && (sendBody || needLength) {
+		f, err := os.Open(res.FilePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// A handler may set just FilePath, leaving its length to Write
+		if needLength {
+			stats, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			if res.Headers == nil {
+				res.Headers = make(Header)
+			}
+			res.Headers.Set("Content-Length", strconv.FormatInt(stats.Size(), 10))
+		}
+		if sendBody {
+			file = f
+		}
+	}
+
 	// Write the response line
 	bw := bufio.NewWriter(w)
 	statusLine := fmt.Sprintf("%v %v %v\r\n", res.Proto, res.StatusCode, res.StatusText)
@@ -108,35 +385,149 @@ func (res *Response) Write(w io.Writer) error {
 		return err
 	}
 	// Write Headers
-	headers := res.Headers
-	headerKeys := make([]string, 0)
-	for key, _ := range headers {
-		headerKeys = append(headerKeys, key)
+	if err := writeHeader(bw, res.Headers); err != nil {
+		return err
 	}
-	sort.Strings(headerKeys)
 
-	for _, key := range headerKeys {
-		keyValue := key + ": " + headers[key] + "\r\n"
-		if _, err := bw.WriteString(keyValue); err != nil {
+	if !sendBody {
+		return bw.Flush()
+	}
+
+	if file != nil {
+		// Stream the file straight to w rather than through bw: when w is
+		// a *net.TCPConn, io.Copy hands the file to sendfile and the body
+		// never passes through user-space memory
+		if len(res.ranges) > 1 {
+			// The part headers are small, so keep them in bw
+			if err := res.writeRanges(bw, file); err != nil {
+				return err
+			}
+			return bw.Flush()
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if len(res.ranges) == 1 {
+			return res.writeRanges(w, file)
+		}
+		return copyFile(w, file, res.Headers.Get("Content-Length"))
+	}
+	if res.Body != nil {
+		if res.Headers.Get("Transfer-Encoding") == "chunked" {
+			return res.writeChunked(bw)
+		}
+		if _, err := io.Copy(bw, res.Body); err != nil {
 			return err
 		}
 	}
-	if _, err := bw.WriteString("\r\n"); err != nil {
+	return bw.Flush()
+}
+
+// writeChunked writes Body in chunked transfer encoding, followed by the
+// Trailers. Every chunk is flushed as soon as it is read, so that a
+// handler streaming its Body reaches the client without delay.
+func (res *Response) writeChunked(bw *bufio.Writer) error {
+	if _, err := io.Copy(chunkedWriter{bw}, res.Body); err != nil {
+		return err
+	}
+	if _, err := bw.WriteString("0\r\n"); err != nil {
 		return err
 	}
+	if err := writeHeader(bw, res.Trailers); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
 
-	filePath := res.FilePath
-	if len(filePath) > 0 {
-		data, err := os.ReadFile(filePath)
-		if err != nil {
-			return err
+// chunkedWriter writes each Write as one chunk.
+type chunkedWriter struct {
+	bw *bufio.Writer
+}
+
+func (cw chunkedWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil // an empty chunk would end the body
+	}
+	if _, err := fmt.Fprintf(cw.bw, "%x\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	if _, err := cw.bw.Write(p); err != nil {
+		return 0, err
+	}
+	if _, err := cw.bw.WriteString("\r\n"); err != nil {
+		return 0, err
+	}
+	return len(p), cw.bw.Flush()
+}
+
+// writeHeader writes each value of h on a line of its own, followed by
+// the empty line that ends a header or trailer section.
+func writeHeader(bw *bufio.Writer, h Header) error {
+	for _, key := range h.sortedKeys() {
+		for _, value := range h[key] {
+			if _, err := bw.WriteString(key + ": " + value + "\r\n"); err != nil {
+				return err
+			}
 		}
-		if _, err := bw.Write(data); err != nil {
-			return err
+	}
+	_, err := bw.WriteString("\r\n")
+	return err
+}
+
+// copyFile copies the file to w. If contentLength is set, exactly that
+// many bytes are copied even if the file has grown since it was announced.
+func copyFile(w io.Writer, file *os.File, contentLength string) error {
+	n, err := strconv.ParseInt(contentLength, 10, 64)
+	if err != nil {
+		_, err = io.Copy(w, file)
+		return err
+	}
+	_, err = io.CopyN(w, file, n)
+	return err
+}
+
+// frameBody makes sure the client can tell where Body ends: from a
+// Content-Length header, from chunked transfer encoding, or because the
+// connection is closed after it.
+func (res *Response) frameBody() {
+	if res.Headers.Has("Content-Length") || !bodyAllowed(res.StatusCode) {
+		return
+	}
+	http11 := res.Request != nil && res.Request.Proto == "HTTP/1.1"
+	if res.Headers.Get("Transfer-Encoding") == "chunked" {
+		if http11 {
+			res.announceTrailers()
+			return
 		}
+		// Clients before HTTP/1.1 cannot decode chunks; they get the
+		// Body as is, without its trailers
+		res.Headers.Del("Transfer-Encoding")
+	}
+	if res.Body == nil {
+		res.Headers.Set("Content-Length", "0")
+		return
 	}
-	if err := bw.Flush(); err != nil {
-		return nil
+	if lr, ok := res.Body.(interface{ Len() int }); ok {
+		res.Headers.Set("Content-Length", strconv.Itoa(lr.Len()))
+		return
 	}
-	return nil
+	if http11 {
+		res.Headers.Set("Transfer-Encoding", "chunked")
+		res.announceTrailers()
+		return
+	}
+	res.Headers.Set("Connection", "close")
+}
+
+// announceTrailers lists the keys of Trailers in the Trailer header.
+func (res *Response) announceTrailers() {
+	if len(res.Trailers) > 0 {
+		res.Headers.Set("Trailer", strings.Join(res.Trailers.sortedKeys(), ", "))
+	}
+}
+
+// bodyAllowed reports whether a response with the given status code may
+// have a body. 1xx, 204 and 304 responses never do.
+func bodyAllowed(code int) bool {
+	return code >= 200 && code != 204 && code != 304
 }
@@ -0,0 +1,216 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// BenchmarkResponseWriteLargeFile serves a large file to many concurrent
+// clients over loopback TCP. Because the body is streamed from the file
+// (and handed to sendfile), B/op and peak-heap-MB stay roughly constant
+// no matter how large the file is or how many downloads run at once.
+func BenchmarkResponseWriteLargeFile(b *testing.B) {
+	const size = 64 << 20
+	docRoot := b.TempDir()
+	f, err := os.Create(filepath.Join(docRoot, "large.bin"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		b.Fatal(err)
+	}
+	f.Close()
+
+	// A sink that reads and discards whatever is written to it
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	var peak uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var stats runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > peak {
+				peak = stats.HeapInuse
+			}
+			runtime.Gosched()
+		}
+	}()
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			res := &Response{}
+			res.HandleOK(docRoot, &Request{Method: "GET", URL: "/large.bin", Path: "/large.bin", Proto: "HTTP/1.1"})
+			if err := res.Write(conn); err != nil {
+				b.Error(err)
+			}
+			conn.Close()
+		}
+	})
+	b.StopTimer()
+	close(done)
+	<-sampled
+	b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+}
+
+// onlyReader hides the Len method of the readers it wraps, so the length
+// of the body is unknown to Response.Write.
+type onlyReader struct {
+	io.Reader
+}
+
+func TestResponseWriteChunked(t *testing.T) {
+	res := &Response{}
+	res.Request = &Request{Method: "GET", URL: "/", Path: "/", Proto: "HTTP/1.1"}
+	res.HandleStatus(200)
+	res.Trailers = Header{"X-Checksum": nil}
+	res.Body = onlyReader{io.MultiReader(
+		strings.NewReader("hello, "),
+		strings.NewReader("world"),
+		readerFunc(func(p []byte) (int, error) {
+			// The trailer value is only known once the body has been read
+			res.Trailers.Set("X-Checksum", "abc")
+			return 0, io.EOF
+		}),
+	)}
+
+	var buf bytes.Buffer
+	if err := res.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Error reading response body: %v\n", err.Error())
+	}
+	if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" || resp.ContentLength != -1 {
+		t.Fatalf("Expected a chunked response but got %v, length %v", resp.TransferEncoding, resp.ContentLength)
+	}
+	if string(body) != "hello, world" {
+		t.Fatalf("Expected body \"hello, world\" but got %q", body)
+	}
+	if resp.Trailer.Get("X-Checksum") != "abc" {
+		t.Fatalf("Expected trailer X-Checksum: abc but got %v", resp.Trailer)
+	}
+	if resp.Close {
+		t.Fatal("Expected a chunked response to keep the connection open")
+	}
+}
+
+func TestResponseWriteUnknownLengthHTTP10(t *testing.T) {
+	res := &Response{}
+	res.Request = &Request{Method: "GET", URL: "/", Path: "/", Proto: "HTTP/1.0"}
+	res.HandleStatus(200)
+	res.Body = onlyReader{strings.NewReader("hello")}
+
+	var buf bytes.Buffer
+	if err := res.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if res.Headers.Has("Transfer-Encoding") || res.Headers.Get("Connection") != "close" {
+		t.Fatalf("Expected a close-delimited body for HTTP/1.0 but got headers %v", res.Headers)
+	}
+	if !strings.HasSuffix(buf.String(), "\r\n\r\nhello") {
+		t.Fatalf("Expected the raw body after the headers but got %q", buf.String())
+	}
+}
+
+func TestResponseWriteChunkedHTTP10(t *testing.T) {
+	res := &Response{}
+	res.Request = &Request{Method: "GET", URL: "/", Path: "/", Proto: "HTTP/1.0"}
+	res.HandleStatus(200)
+	res.Headers.Set("Transfer-Encoding", "chunked")
+	res.Trailers = Header{"X-Checksum": {"abc"}}
+	res.Body = onlyReader{strings.NewReader("hello")}
+
+	var buf bytes.Buffer
+	if err := res.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if res.Headers.Has("Transfer-Encoding") || res.Headers.Has("Trailer") || res.Headers.Get("Connection") != "close" {
+		t.Fatalf("Expected chunking to be dropped for HTTP/1.0 but got headers %v", res.Headers)
+	}
+	if !strings.HasSuffix(buf.String(), "\r\n\r\nhello") {
+		t.Fatalf("Expected the raw body after the headers but got %q", buf.String())
+	}
+}
+
+func TestResponseWriteFileLength(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(filePath, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{"GET", "HEAD"} {
+		// A handler setting only FilePath
+		res := &Response{}
+		res.Request = &Request{Method: method, URL: "/", Path: "/", Proto: "HTTP/1.1"}
+		res.HandleStatus(200)
+		res.FilePath = filePath
+
+		var buf bytes.Buffer
+		if err := res.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(&buf), &http.Request{Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		want := "hello"
+		if method == "HEAD" {
+			want = ""
+		}
+		if resp.ContentLength != 5 || string(body) != want || resp.Close {
+			t.Fatalf("%s: expected Content-Length 5 and body %q but got %v %q", method, want, resp.ContentLength, body)
+		}
+	}
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
@@ -2,173 +2,901 @@ package tritonhttp
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrServerClosed is returned by ListenAndServe and Serve after a call
+// to Shutdown or Close.
+var ErrServerClosed = errors.New("tritonhttp: Server closed")
+
+// shutdownPollInterval is how often Shutdown checks whether all
+// connections have gone idle and been closed.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// connState tracks whether a connection is in the middle of a request
+// or waiting for the next one on a keep-alive connection.
+type connState int
+
+const (
+	stateIdle connState = iota
+	stateActive
+)
+
 type Server struct {
 	// Addr specifies the TCP address for the server to listen on,
 	// in the form "host:port". It shall be passed to net.Listen()
 	// during ListenAndServe().
 	Addr string // e.g. ":0"
 
-	// VirtualHosts contains a mapping from host name to the docRoot path
-	// (i.e. the path to the directory to serve static files from) for
-	// all virtual hosts that this server supports
-	VirtualHosts map[string]string
+	// VirtualHosts maps the names of all virtual hosts that this server
+	// supports to the host, which holds its docRoot (i.e. the path to the
+	// directory to serve static files from) and its settings. Host names
+	// may also be wildcards or regular expressions; see
+	// ParseVHConfigFile.
+	VirtualHosts map[string]*VirtualHost
+
+	// Handler responds to every valid request. If it is nil, the server
+	// serves static files from VirtualHosts using a FileHandler.
+	Handler Handler
+
+	// Middleware wraps Handler for every request; Middleware[0] is the
+	// outermost layer.
+	Middleware []Middleware
+
+	// HostMiddleware maps host names to extra middleware that only wraps
+	// requests for that virtual host. It runs inside Middleware. Its keys
+	// are the HostName of each virtual host, so a wildcard name covers
+	// every host it matches, and requests for an alias get the middleware
+	// of the host it belongs to. A virtual host without a HostName is
+	// keyed by its name in VirtualHosts. The HostSettings of the virtual
+	// host wrap it.
+	HostMiddleware map[string][]Middleware
+
+	// MaxBodyBytes is the largest request body the server accepts; larger
+	// ones get a 413. If it is 0, DefaultMaxBodyBytes is used. Virtual
+	// hosts may set their own limit.
+	MaxBodyBytes int64
+
+	// ReadTimeout bounds how long the server waits for a request, and
+	// once its headers have been read, for its body. If it is 0,
+	// DefaultReadTimeout is used. WriteTimeout bounds the time from the
+	// end of the headers to the end of the response; if it is 0, there is
+	// no limit. Virtual hosts may set their own timeouts, which also apply
+	// to waiting for the next request on the same connection.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// StrictParsing rejects requests that RFC 9112 does not allow but
+	// that are tolerated by default: bare CR or LF line endings,
+	// whitespace between a header name and its colon, invalid characters
+	// in header names and values, and requests framed by both
+	// Content-Length and Transfer-Encoding.
+	StrictParsing bool
+
+	// DefaultHost is the virtual host that serves requests for hosts not
+	// in VirtualHosts, including HTTP/1.0 requests without a Host header.
+	// If it is empty, such requests get a 421.
+	DefaultHost string
+
+	// MaxRequestLineBytes limits the length of the request line; longer
+	// ones get a 414. If it is 0, DefaultMaxRequestLineBytes is used.
+	MaxRequestLineBytes int
+
+	// MaxHeaderBytes limits the total size of the header fields, and
+	// MaxHeaderCount their number; requests over either limit get a 431.
+	// If they are 0, DefaultMaxHeaderBytes and DefaultMaxHeaderCount are
+	// used.
+	MaxHeaderBytes int
+	MaxHeaderCount int
+
+	mu             sync.Mutex
+	listeners      map[net.Listener]struct{}
+	conns          map[net.Conn]connState
+	accessLogs     map[string]*log.Logger
+	accessLogFiles []*os.File
+	inShutdown     atomic.Bool
 }
 
 // ValidateServerSetup checks the validity of the docRoot of the server
 func (s *Server) ValidateServerSetup() error {
 	// Validating the doc root of the server
-	for _, docRoot := range s.VirtualHosts {
-		fi, err := os.Stat(docRoot)
-		if os.IsNotExist(err) {
+	for name, vh := range s.VirtualHosts {
+		if strings.HasPrefix(name, "~") {
+			// The docRoot depends on the host, so only the pattern can
+			// be checked in advance
+			if _, err := hostPattern(name[1:]); err != nil {
+				return err
+			}
+			continue
+		}
+		fi, err := os.Stat(vh.DocRoot)
+		if err != nil {
 			return err
 		}
 		if !fi.IsDir() {
-			return fmt.Errorf("doc root %q is not a directory", docRoot)
+			return fmt.Errorf("doc root %q is not a directory", vh.DocRoot)
 		}
 	}
+	if _, ok := s.VirtualHosts[s.DefaultHost]; s.DefaultHost != "" && len(s.VirtualHosts) > 0 && !ok {
+		return fmt.Errorf("default host %q is not a virtual host", s.DefaultHost)
+	}
 	return nil
 }
 
 // ListenAndServe listens on the TCP network address s.Addr and then
 // handles requests on incoming connections.
 func (s *Server) ListenAndServe() error {
-	// Hint: Validate all docRoots
-	if err := s.ValidateServerSetup(); err != nil {
-		return fmt.Errorf("server is not setup correctly %v", err)
+	if s.shuttingDown() {
+		return ErrServerClosed
 	}
 	ln, err := net.Listen("tcp", "localhost"+s.Addr)
 	if err != nil {
 		return fmt.Errorf("listening error: %v", err)
 	}
-	defer ln.Close()
 	log.Printf("Listening on %s", ln.Addr())
+	return s.Serve(ln)
+}
+
+// Serve accepts incoming connections on ln and handles each of them in
+// its own goroutine. It always closes ln before returning, and returns
+// ErrServerClosed once Shutdown or Close has been called.
+func (s *Server) Serve(ln net.Listener) error {
+	// Hint: Validate all docRoots
+	if err := s.ValidateServerSetup(); err != nil {
+		ln.Close()
+		return fmt.Errorf("server is not setup correctly %v", err)
+	}
+	if !s.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+	defer ln.Close()
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			continue
 		}
 		go s.HandleConnection(conn)
 	}
 }
 
+// Shutdown gracefully shuts down the server. It first closes all open
+// listeners, then closes connections that are idle between requests, and
+// then waits for in-flight requests to finish writing their response
+// before closing those connections too. If ctx expires first, Shutdown
+// returns the context's error and the remaining connections are left to
+// finish on their own; call Close to cut them off.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			s.mu.Lock()
+			s.closeAccessLogsLocked()
+			s.mu.Unlock()
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes all listeners and all connections, whether
+// they are idle or in the middle of a request. For a graceful shutdown,
+// use Shutdown.
+func (s *Server) Close() error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.closeListenersLocked()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+	s.closeAccessLogsLocked()
+	return err
+}
+
+// handler returns the Handler that req, for the virtual host vh, should
+// be dispatched to, wrapped in the server-wide and per-host middleware.
+func (s *Server) handler(req *Request, vh hostMatch) Handler {
+	h := s.Handler
+	if h == nil {
+		h = &FileHandler{VirtualHosts: s.VirtualHosts}
+	}
+	if vh.host == nil {
+		h = Chain(h, s.HostMiddleware[req.Host]...)
+		return Chain(h, s.Middleware...)
+	}
+	h = Chain(h, s.HostMiddleware[vh.primaryName()]...)
+	h = Chain(h, s.hostSettings(vh)...)
+	return Chain(h, s.Middleware...)
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+// trackListener adds or removes ln from the set of listeners closed by
+// Shutdown and Close. Adding reports false if the server is already
+// shutting down.
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.listeners[ln] = struct{}{}
+	} else {
+		delete(s.listeners, ln)
+	}
+	return true
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for ln := range s.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, ln)
+	}
+	return err
+}
+
+// setConnState records the state of conn so that Shutdown knows whether
+// it may be closed. It reports false if an idle connection should stop
+// serving because the server is shutting down.
+func (s *Server) setConnState(conn net.Conn, state connState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]connState)
+	}
+	s.conns[conn] = state
+	return state == stateActive || !s.shuttingDown()
+}
+
+func (s *Server) forgetConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// closeIdleConns closes every connection that is waiting for a new
+// request and reports whether no connections remain.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.conns {
+		if state == stateIdle {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0
+}
+
 // HandleConnection reads requests from the accepted conn and handles them.
 func (s *Server) HandleConnection(conn net.Conn) {
+	defer s.forgetConn(conn)
 	br := bufio.NewReader(conn)
+	readTimeout := s.readTimeout(nil)
 	for {
-		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-		req, err, isEOF := ReadRequest(br)
+		if !s.setConnState(conn, stateIdle) {
+			_ = conn.Close()
+			return
+		}
+		conn.SetReadDeadline(deadline(readTimeout))
+		conn.SetWriteDeadline(time.Time{})
+		// Wait for the first byte of the next request before marking the
+		// connection active, so that Shutdown can close it while idle.
+		if _, err := br.Peek(1); err != nil {
+			_ = conn.Close()
+			return
+		}
+		s.setConnState(conn, stateActive)
+		req, err, isEOF := readRequest(br, s.parseOptions())
 		if isEOF {
 			_ = conn.Close()
 			return
 		}
-		fmt.Println("Request: ", req)
 
 		res := &Response{}
-		res.Headers = make(map[string]string)
-		if req != nil && req.Close {
-			res.Headers["Connection"] = "close"
-		}
+		res.Headers = make(Header)
 		if err != nil {
-			res.HandleBadRequest()
-			fmt.Println("writing response(400)")
+			var se *statusError
+			if errors.As(err, &se) {
+				res.HandleStatus(se.code)
+				res.Headers.Set("Connection", "close")
+			} else {
+				res.HandleBadRequest()
+			}
+			fmt.Printf("writing response(%d)\n", res.StatusCode)
 			err = res.Write(conn)
 			if err != nil {
-				fmt.Println("Error in writing response(400): ", err)
+				fmt.Printf("Error in writing response(%d): %v\n", res.StatusCode, err)
 			}
-			fmt.Println("Response: ", res)
-			_ = conn.Close()
+			closeUnread(conn)
 			return
 		}
-		res.HandleOK(s.VirtualHosts[req.Host], req) // pass the docRoot of the host to HandleOK
+		res.Request = req
+		host, hostOK := s.virtualHost(req.Host)
+		req.Host = host
+		vh, _ := resolveVirtualHost(s.VirtualHosts, req.Host)
+		readTimeout = s.readTimeout(vh.host)
+		conn.SetReadDeadline(deadline(readTimeout))
+		conn.SetWriteDeadline(deadline(s.writeTimeout(vh.host)))
+		location, redirect := canonicalLocation(req, vh)
+		var expect *continueReader
+		if req.expectContinue {
+			expect = &continueReader{r: req.Body, w: conn}
+			req.Body = expect
+		}
+		body := &maxBytesReader{r: req.Body, n: s.maxBodyBytes(vh.host)}
+		req.Body = body
+		switch {
+		case !knownMethods[req.Method]:
+			res.HandleNotImplemented()
+		case !hostOK:
+			res.HandleMisdirectedRequest()
+		case redirect:
+			res.HandleMovedPermanently(location)
+		case req.ContentLength > body.n:
+			// No need to read a body that is known to be too large
+			res.HandlePayloadTooLarge()
+		default:
+			res.HandleStatus(200)
+			s.handler(req, vh).ServeTritonHTTP(res, req)
+			if body.exceeded {
+				res.Headers = make(Header)
+				res.HandlePayloadTooLarge()
+			}
+		}
+		if res.Headers == nil {
+			res.Headers = make(Header)
+		}
+		// A client still waiting for 100 Continue may or may not send
+		// the body now, so the connection cannot be reused
+		waiting := expect != nil && !expect.sent
+		if req.Close || waiting || s.shuttingDown() {
+			res.Headers.Set("Connection", "close")
+		} else if req.Proto == "HTTP/1.0" && !res.Headers.Has("Connection") {
+			// HTTP/1.0 connections only persist if both sides say so
+			res.Headers.Set("Connection", "keep-alive")
+		}
 		err = res.Write(conn)
+		req.removeMultipartFiles()
 		if err != nil {
+			// The client may have received a partial response, so the
+			// connection cannot be reused
 			fmt.Println("Error in writing response: ", err)
+			_ = conn.Close()
+			return
 		}
-		fmt.Println("Response: ", res)
 
-		if res.Headers["Connection"] == "close" {
+		if res.Headers.hasToken("Connection", "close") {
 			_ = conn.Close()
 			return
 		}
+		// Discard whatever the handler did not read, so the next request
+		// starts where this one's body ends
+		if _, err := io.Copy(io.Discard, req.Body); err != nil {
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// lingerTimeout bounds how long closeUnread waits for the client to
+// stop sending.
+const lingerTimeout = 500 * time.Millisecond
+
+// closeUnread closes conn after a response to a request that was not
+// read to the end. Closing a socket with unread input makes the kernel
+// reset the connection, which can discard the response before the client
+// reads it, so the write side is shut first and the input drained until
+// the client closes its side or lingerTimeout passes.
+func closeUnread(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.CloseWrite()
+		_ = conn.SetReadDeadline(time.Now().Add(lingerTimeout))
+		_, _ = io.Copy(io.Discard, conn)
+	}
+	_ = conn.Close()
+}
+
+func (s *Server) parseOptions() *parseOptions {
+	return &parseOptions{
+		strict:          s.StrictParsing,
+		maxRequestLine:  s.MaxRequestLineBytes,
+		maxHeaderBytes:  s.MaxHeaderBytes,
+		maxHeaderFields: s.MaxHeaderCount,
+	}
+}
+
+// Default limits on the parts of a request read before its body.
+const (
+	DefaultMaxRequestLineBytes = 8 << 10
+	DefaultMaxHeaderBytes      = 64 << 10
+	DefaultMaxHeaderCount      = 100
+)
+
+// A statusError is a malformed request that calls for a response status
+// other than 400 Bad Request.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+// errLineTooLong is returned by readRawLine for a line over its limit.
+var errLineTooLong = errors.New("line too long")
+
+// parseOptions controls how requests are parsed. Limits that are 0 take
+// their default value.
+type parseOptions struct {
+	// strict rejects everything RFC 9112 does not allow, instead of
+	// tolerating common client mistakes such as bare LF line endings or
+	// whitespace around header names.
+	strict bool
+
+	maxRequestLine  int
+	maxHeaderBytes  int
+	maxHeaderFields int
+}
+
+func (opts *parseOptions) requestLineLimit() int {
+	if opts.maxRequestLine > 0 {
+		return opts.maxRequestLine
+	}
+	return DefaultMaxRequestLineBytes
+}
+
+func (opts *parseOptions) headerBytesLimit() int {
+	if opts.maxHeaderBytes > 0 {
+		return opts.maxHeaderBytes
+	}
+	return DefaultMaxHeaderBytes
+}
+
+func (opts *parseOptions) headerCountLimit() int {
+	if opts.maxHeaderFields > 0 {
+		return opts.maxHeaderFields
 	}
+	return DefaultMaxHeaderCount
 }
 
-// ReadRequest reads and parses a request from the buffered reader.
+// ReadRequest reads and parses a request from the buffered reader. It
+// tolerates the client mistakes that Server.StrictParsing rejects, and
+// applies the default limits on the request line and headers.
 func ReadRequest(br *bufio.Reader) (req *Request, err error, isEOF bool) {
+	return readRequest(br, &parseOptions{})
+}
+
+func readRequest(br *bufio.Reader, opts *parseOptions) (req *Request, err error, isEOF bool) {
 	req = &Request{} // Method, URL, Proto, Headers, Host, Close
 	// Read the first line of the request, which contains the method, URL, and protocol eg. GET /index.html HTTP/1.1
-	firstLine, err := br.ReadString('\n')
+	firstLine, err := readRawLine(br, opts.requestLineLimit())
+	if err == errLineTooLong {
+		return nil, &statusError{414, "request line too long"}, false
+	}
 	if err != nil {
 		return nil, err, true
 	}
-	err = parseFirstLine(firstLine, req)
+	err = parseFirstLine(firstLine, req, opts)
 	if err != nil {
 		fmt.Println("Error in parsing first line: ", err)
 		return nil, err, false
 	}
-	req.Headers = make(map[string]string)
-	err = parseHeaders(br, req)
+	req.Headers = make(Header)
+	err = parseHeaders(br, req.Headers, opts)
 	if err != nil {
 		fmt.Println("Error in parsing headers: ", err)
 		return nil, err, false
 	}
-	req.Host = req.Headers["Host"]
-	req.Close = req.Headers["Connection"] == "close"
+	if err := setupHost(req); err != nil {
+		return nil, err, false
+	}
+	if req.Proto == "HTTP/1.0" {
+		req.Close = !req.Headers.hasToken("Connection", "keep-alive")
+	} else {
+		req.Close = req.Headers.hasToken("Connection", "close")
+	}
+	if err := setupBody(req, br, opts); err != nil {
+		fmt.Println("Error in parsing body framing: ", err)
+		return nil, err, false
+	}
+	// HTTP/1.0 clients cannot send expectations, so they are ignored
+	if req.Headers.Has("Expect") && req.Proto == "HTTP/1.1" {
+		if expect := req.Headers.list("Expect"); !strings.EqualFold(expect, "100-continue") {
+			return nil, &statusError{417, fmt.Sprintf("unsupported expectation: %q", expect)}, false
+		}
+		req.expectContinue = req.ContentLength != 0
+	}
 	return req, nil, false
 }
 
-func parseHeaders(br *bufio.Reader, req *Request) error {
+// readRawLine reads a line of at most limit bytes, including its line
+// ending, without buffering more than that however long the line is.
+func readRawLine(br *bufio.Reader, limit int) (string, error) {
+	var line []byte
 	for {
-		line, err := br.ReadString('\n')
+		frag, err := br.ReadSlice('\n')
+		if len(line)+len(frag) > limit {
+			return "", errLineTooLong
+		}
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// readLine reads a line of at most limit bytes and strips its line
+// ending. In strict mode the line must end in CRLF and may not contain
+// any other CR.
+func readLine(br *bufio.Reader, opts *parseOptions, limit int) (string, error) {
+	line, err := readRawLine(br, limit)
+	if err != nil {
+		return "", err
+	}
+	return trimLineEnding(line, opts)
+}
+
+func trimLineEnding(line string, opts *parseOptions) (string, error) {
+	if !opts.strict {
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", fmt.Errorf("line not terminated by CRLF: %q", line)
+	}
+	line = line[:len(line)-2]
+	if strings.ContainsRune(line, '\r') {
+		return "", fmt.Errorf("bare CR in line: %q", line)
+	}
+	return line, nil
+}
+
+// parseHeaders reads header fields into h up to the empty line that ends
+// them. Folded lines, which begin with whitespace, are always rejected:
+// reading them as fields of their own would frame the request
+// differently from a server that unfolds them.
+//
+// The header section, including the empty line, may be at most
+// opts.headerBytesLimit() bytes long and hold opts.headerCountLimit()
+// fields.
+func parseHeaders(br *bufio.Reader, h Header, opts *parseOptions) error {
+	remaining := opts.headerBytesLimit()
+	for fields := 0; ; fields++ {
+		raw, err := readRawLine(br, remaining)
+		if err == errLineTooLong {
+			return &statusError{431, "header section too large"}
+		}
 		if err != nil {
 			fmt.Println("Error in reading line: ", err)
 			return err
 		}
-		line = strings.TrimSpace(line)
-		if line == "" {
+		remaining -= len(raw)
+		line, err := trimLineEnding(raw, opts)
+		if err != nil {
+			return err
+		}
+		if !opts.strict {
+			if strings.TrimSpace(line) == "" {
+				break
+			}
+		} else if line == "" {
 			break
 		}
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) != 2 {
-			return fmt.Errorf("invalid header: %q", line)
+		if fields == opts.headerCountLimit() {
+			return &statusError{431, "too many header fields"}
 		}
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
-		// ensure have valid key and value
-		if key == "" || value == "" {
-			return fmt.Errorf("invalid header: %q", line)
+		if line[0] == ' ' || line[0] == '\t' {
+			return fmt.Errorf("obsolete line folding: %q", line)
 		}
-		req.Headers[key] = value
+		key, value, err := parseHeaderLine(line, opts)
+		if err != nil {
+			return err
+		}
+		h.Add(key, value)
 	}
 	return nil
 }
 
-func parseFirstLine(firstLine string, req *Request) error {
-	//trimSpace removes leading and trailing whitespaces for the first line
-	firstLine = strings.TrimSpace(firstLine)
+func parseHeaderLine(line string, opts *parseOptions) (key, value string, err error) {
+	key, value, found := strings.Cut(line, ":")
+	if !found {
+		return "", "", fmt.Errorf("invalid header: %q", line)
+	}
+	if opts.strict {
+		// No whitespace is allowed between the name and the colon
+		value = strings.Trim(value, " \t")
+		if !isToken(key) || !isFieldValue(value) {
+			return "", "", fmt.Errorf("invalid header: %q", line)
+		}
+	} else {
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+	}
+	// ensure have valid key and value
+	if key == "" || value == "" {
+		return "", "", fmt.Errorf("invalid header: %q", line)
+	}
+	return key, value, nil
+}
+
+func parseFirstLine(firstLine string, req *Request, opts *parseOptions) error {
+	firstLine, err := trimLineEnding(firstLine, opts)
+	if err != nil {
+		return err
+	}
+	if !opts.strict {
+		//trimSpace removes leading and trailing whitespaces for the first line
+		firstLine = strings.TrimSpace(firstLine)
+	}
 	parts := strings.Split(firstLine, " ")
 	if len(parts) != 3 {
 		return fmt.Errorf("invalid first line: %q", firstLine)
 	}
-	if parts[0] != "GET" {
+	// Any token is a syntactically valid method; whether the server
+	// supports it is decided after the whole request has been read.
+	if !isToken(parts[0]) {
 		return fmt.Errorf("invalid method: %q", parts[0])
 	}
 	req.Method = parts[0]
-	if !strings.HasPrefix(parts[1], "/") {
-		return fmt.Errorf("invalid URL: %q", parts[1])
-	}
 	req.URL = parts[1]
-	protocol := strings.TrimSpace(parts[2])
-	if protocol != "HTTP/1.1" {
+	if opts.strict && !isVisibleASCII(req.URL) {
+		return fmt.Errorf("invalid URL: %q", req.URL)
+	}
+	if err := parseTarget(req); err != nil {
+		return err
+	}
+	protocol := parts[2]
+	if !opts.strict {
+		protocol = strings.TrimSpace(protocol)
+	}
+	if !isHTTPVersion(protocol) {
 		return fmt.Errorf("invalid protocol: %q", parts[2])
 	}
+	if protocol != "HTTP/1.1" && protocol != "HTTP/1.0" {
+		return &statusError{505, fmt.Sprintf("unsupported protocol: %q", protocol)}
+	}
+	req.Proto = protocol
 	return nil
 }
+
+// isHTTPVersion reports whether s has the syntax of an HTTP version,
+// "HTTP/" followed by a digit, a dot and another digit.
+func isHTTPVersion(s string) bool {
+	return len(s) == len("HTTP/1.1") && strings.HasPrefix(s, "HTTP/") &&
+		isDigits(s[5:6]) && s[6] == '.' && isDigits(s[7:])
+}
+
+// setupHost sets req.Host from the request-target or the Host header.
+// HTTP/1.1 requests must have exactly one Host header, even if the
+// target names the host.
+func setupHost(req *Request) error {
+	hosts := req.Headers.Values("Host")
+	if len(hosts) > 1 || (len(hosts) == 0 && req.Proto == "HTTP/1.1") {
+		return fmt.Errorf("%d Host headers", len(hosts))
+	}
+	host := req.targetHost
+	if host == "" && len(hosts) == 1 {
+		host = hosts[0]
+	} else if host == "" {
+		return nil // an HTTP/1.0 request for the default host
+	}
+	// The host in an absolute-form target overrides the Host header
+	var err error
+	req.Host, err = parseHost(host)
+	return err
+}
+
+// parseHost normalizes the host of a Host header or request-target, so
+// that it can be looked up in Server.VirtualHosts: any port is dropped
+// and names are lowercased, e.g. "WEBSITE1:8080" becomes "website1". IPv6
+// literals keep their brackets but are written in their shortest form.
+func parseHost(hostport string) (string, error) {
+	host, port := hostport, ""
+	if strings.HasPrefix(host, "[") {
+		end := strings.IndexByte(host, ']')
+		if end < 0 {
+			return "", fmt.Errorf("invalid host: %q", hostport)
+		}
+		host, port = host[1:end], host[end+1:]
+		ip := net.ParseIP(host)
+		if ip == nil || !strings.Contains(host, ":") {
+			return "", fmt.Errorf("invalid IPv6 address: %q", hostport)
+		}
+		host = "[" + ip.String() + "]"
+	} else {
+		if i := strings.LastIndexByte(host, ':'); i >= 0 {
+			host, port = host[:i], host[i:]
+		}
+		if !isRegName(host) {
+			return "", fmt.Errorf("invalid host: %q", hostport)
+		}
+		host = strings.ToLower(host)
+	}
+	if port != "" && port != ":" && !(port[0] == ':' && isDigits(port[1:])) {
+		return "", fmt.Errorf("invalid port: %q", hostport)
+	}
+	return host, nil
+}
+
+// isRegName reports whether s is a non-empty host name or IPv4 address,
+// made of the characters RFC 3986 allows in a reg-name.
+func isRegName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("-._~%!$&'()*+,;=", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parseTarget parses req.URL in any of the four forms of RFC 9112,
+// Section 3.2: origin-form ("/index.html?v=2"), absolute-form
+// ("http://website1/index.html"), authority-form ("website1:443", only
+// for CONNECT) and asterisk-form ("*", only for OPTIONS).
+func parseTarget(req *Request) error {
+	switch {
+	case strings.HasPrefix(req.URL, "/"):
+		return parseOriginForm(req, req.URL)
+	case req.URL == "*":
+		if req.Method != "OPTIONS" {
+			return fmt.Errorf("invalid URL for %s: %q", req.Method, req.URL)
+		}
+		req.Path = "*"
+		return nil
+	case req.Method == "CONNECT":
+		if _, _, err := net.SplitHostPort(req.URL); err != nil || strings.ContainsAny(req.URL, "/?#@") {
+			return fmt.Errorf("invalid URL: %q", req.URL)
+		}
+		req.targetHost = req.URL
+		return nil
+	}
+
+	// absolute-form, as sent to proxies
+	scheme, rest, ok := strings.Cut(req.URL, "://")
+	if !ok || !(strings.EqualFold(scheme, "http") || strings.EqualFold(scheme, "https")) {
+		return fmt.Errorf("invalid URL: %q", req.URL)
+	}
+	authority, pathAndQuery := rest, "/"
+	if i := strings.IndexAny(rest, "/?"); i >= 0 {
+		authority, pathAndQuery = rest[:i], rest[i:]
+		if pathAndQuery[0] == '?' {
+			pathAndQuery = "/" + pathAndQuery
+		}
+	}
+	if authority == "" || strings.ContainsAny(authority, "@#") {
+		return fmt.Errorf("invalid URL: %q", req.URL)
+	}
+	req.targetHost = authority
+	return parseOriginForm(req, pathAndQuery)
+}
+
+// parseOriginForm splits target into its path and query. The path is
+// percent-decoded, but encoded slashes and NULs are rejected: they would
+// let a client reach files whose names do not match the path it sent.
+func parseOriginForm(req *Request, target string) error {
+	rawPath, rawQuery, _ := strings.Cut(target, "?")
+	if strings.Contains(rawPath, "#") || strings.Contains(rawQuery, "#") {
+		return fmt.Errorf("invalid URL: %q", req.URL) // fragments are never sent
+	}
+	lower := strings.ToLower(rawPath)
+	if strings.Contains(lower, "%2f") || strings.Contains(lower, "%00") {
+		return fmt.Errorf("invalid URL: %q", req.URL)
+	}
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %q", req.URL)
+	}
+	req.Path = path
+	req.RawQuery = rawQuery
+	// Malformed pairs are skipped rather than failing the whole request
+	req.Query, _ = url.ParseQuery(rawQuery)
+	return nil
+}
+
+// knownMethods are the methods the server recognises. Requests with any
+// other method get a 501; a Handler answers a known method it does not
+// allow with a 405.
+var knownMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"POST":    true,
+	"PUT":     true,
+	"DELETE":  true,
+	"CONNECT": true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PATCH":   true,
+	// WebDAV
+	"MKCOL":    true,
+	"COPY":     true,
+	"MOVE":     true,
+	"PROPFIND": true,
+}
+
+// isToken reports whether s is a non-empty RFC 9110 token, the syntax of
+// methods and header field names.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// isFieldValue reports whether s is a valid header field value: no
+// control characters other than tab.
+func isFieldValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// isVisibleASCII reports whether s is made only of printable ASCII other
+// than space, as a request-target must be.
+func isVisibleASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -27,6 +27,29 @@ func FormatTime(t time.Time) string {
 	return s
 }
 
+// httpTimeFormats are the date formats a recipient must accept, in order
+// of preference: IMF-fixdate, then the obsolete RFC 850 and ANSI C
+// asctime() formats (RFC 9110, Section 5.6.7).
+var httpTimeFormats = []string{
+	"Mon, 02 Jan 2006 15:04:05 GMT",
+	"Monday, 02-Jan-06 15:04:05 GMT",
+	"Mon Jan _2 15:04:05 2006",
+}
+
+// ParseHTTPTime parses a date from a header such as "If-Modified-Since",
+// accepting any of the three formats allowed by the HTTP spec.
+func ParseHTTPTime(s string) (time.Time, error) {
+	var err error
+	for _, layout := range httpTimeFormats {
+		var t time.Time
+		t, err = time.Parse(layout, s)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
 // MIMETypeByExtension returns the MIME type associated with the
 // file extension ext. The extension ext should begin with a
 // leading dot, as in ".html". When ext has no associated type,
@@ -0,0 +1,33 @@
+package tritonhttp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseHTTPTime(t *testing.T) {
+	want := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	tests := []struct {
+		in string
+		ok bool
+	}{
+		{"Sun, 06 Nov 1994 08:49:37 GMT", true},  // IMF-fixdate
+		{"Sunday, 06-Nov-94 08:49:37 GMT", true}, // RFC 850
+		{"Sun Nov  6 08:49:37 1994", true},       // asctime
+		{"Sun, 06 Nov 1994 08:49:37 PST", false},
+		{"", false},
+		{"yesterday", false},
+	}
+	for _, tt := range tests {
+		got, err := ParseHTTPTime(tt.in)
+		if tt.ok && (err != nil || !got.Equal(want)) {
+			t.Errorf("ParseHTTPTime(%q) = %v, %v; want %v", tt.in, got, err, want)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("ParseHTTPTime(%q) = %v; want an error", tt.in, got)
+		}
+	}
+	if got := FormatTime(want); got != "Sun, 06 Nov 1994 08:49:37 GMT" {
+		t.Errorf("FormatTime did not round-trip, got %q", got)
+	}
+}
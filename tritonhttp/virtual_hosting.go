@@ -1,42 +1,416 @@
 package tritonhttp
 
 import (
-	"io/ioutil"
-	"log"
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"gopkg.in/yaml.v2"
 )
 
+// VHConfigs is the virtual hosting config file. Settings in Defaults
+// apply to every virtual host that does not set them itself.
 type VHConfigs struct {
-	VirtualHosts []struct {
-		HostName string `yaml:"hostName"`
-		DocRoot  string `yaml:"docRoot"`
-	} `yaml:"virtual_hosts"`
+	Defaults     HostSettings  `yaml:"defaults"`
+	VirtualHosts []VirtualHost `yaml:"virtual_hosts"`
 }
 
-func ParseVHConfigFile(vhConfigFilePath string, docroot_dirs_path string) map[string]string {
-	vh_map := make(map[string]string)
-	f, err := ioutil.ReadFile(vhConfigFilePath)
+// VirtualHost is a host served by a Server, as described by an entry in
+// the virtual hosting config file.
+type VirtualHost struct {
+	HostName string   `yaml:"hostName"`
+	Aliases  []string `yaml:"aliases"` // other names served from the same docRoot
+	DocRoot  string   `yaml:"docRoot"`
+	Writable bool     `yaml:"writable"` // allow PUT, DELETE, MKCOL, COPY and MOVE
 
-	if err != nil {
-		log.Fatalf("could not read config file %s : %v", vhConfigFilePath, err)
+	// CanonicalHost, if set, is the one name of the host that is
+	// served; requests for its other names are redirected to it.
+	CanonicalHost string `yaml:"canonicalHost"`
+
+	HostSettings `yaml:",inline"`
+}
+
+// hostNames returns the name of a virtual host followed by its aliases.
+func hostNames(hostName string, aliases []string) []string {
+	return append([]string{hostName}, aliases...)
+}
+
+// A ConfigError is a problem found in a virtual hosting config file.
+type ConfigError struct {
+	Path string // the config file
+	Line int    // the line of the problem, or 0 if it is not known
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %v", e.Path, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+// ConfigErrors lists every problem found in a virtual hosting config
+// file, in the order they were found.
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
 	}
+	return strings.Join(msgs, "\n")
+}
+
+// yamlErrorLine matches the messages of the yaml package that give the
+// line of a problem, e.g. "line 3: field foo not found in type ...".
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
 
+// virtualHostsKey matches the line that starts the virtual_hosts list.
+var virtualHostsKey = regexp.MustCompile(`^["']?virtual_hosts["']?\s*:\s*(?:#.*)?$`)
+
+// readVHConfigFile reads and decodes the virtual hosting config file,
+// reporting keys it does not know and values of the wrong type in
+// ConfigErrors. The rest of the file is still decoded, so that its
+// entries can be checked as well. It also returns the line of each entry
+// in VirtualHosts, or nil if they cannot be told apart. The error is for
+// a file that cannot be read or is not valid YAML.
+func readVHConfigFile(vhConfigFilePath string) (VHConfigs, []int, ConfigErrors, error) {
 	vhostConfigs := VHConfigs{}
-	err = yaml.Unmarshal(f, &vhostConfigs)
+	f, err := os.ReadFile(vhConfigFilePath)
+	if err != nil {
+		return vhostConfigs, nil, nil, err
+	}
+
+	var errs ConfigErrors
+	if err := yaml.UnmarshalStrict(f, &vhostConfigs); err != nil {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			// A syntax error leaves nothing to check
+			return vhostConfigs, nil, nil, yamlErrors(vhConfigFilePath, []string{err.Error()})
+		}
+		errs = yamlErrors(vhConfigFilePath, typeErr.Errors)
+		vhostConfigs = VHConfigs{}
+		_ = yaml.Unmarshal(f, &vhostConfigs) // the same type errors again
+	}
+
+	// The yaml package does not say where values came from, so the
+	// entries are found in the source
+	lines := entryLines(f)
+	if len(lines) != len(vhostConfigs.VirtualHosts) {
+		lines = nil
+	}
+	return vhostConfigs, lines, errs, nil
+}
+
+// yamlErrors turns the messages of the yaml package into ConfigErrors.
+func yamlErrors(vhConfigFilePath string, msgs []string) ConfigErrors {
+	var errs ConfigErrors
+	for _, msg := range msgs {
+		configErr := &ConfigError{Path: vhConfigFilePath, Err: errors.New(msg)}
+		if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+			configErr.Line, _ = strconv.Atoi(m[1])
+			configErr.Err = errors.New(m[2])
+		}
+		errs = append(errs, configErr)
+	}
+	return errs
+}
+
+// entryLines returns the line of each entry in the virtual_hosts list of
+// a config file: the line of its "-", whether the entry is written in
+// block style or in flow style, e.g. "- {hostName: a, docRoot: b}".
+func entryLines(src []byte) []int {
+	var lines []int
+	inHosts := false
+	itemIndent := -1
+	for i, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(trimmed)
+		isItem := trimmed == "-" || strings.HasPrefix(trimmed, "- ")
+		if indent == 0 && !isItem {
+			// A top-level key ends the list before it
+			inHosts = virtualHostsKey.MatchString(trimmed)
+			continue
+		}
+		if !inHosts || !isItem {
+			continue
+		}
+		// Items of lists nested in an entry, such as its aliases, are
+		// indented further than the entries
+		if itemIndent < 0 {
+			itemIndent = indent
+		}
+		if indent == itemIndent {
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
+}
+
+// ParseVHConfigFile reads the virtual hosting config file and maps every
+// name of each virtual host, aliases included, to the host. DocRoots are
+// made relative to docroot_dirs_path, settings the host leaves unset are
+// taken from the defaults block, and the canonical host is lowercased and
+// loses any port, like a Host header.
+//
+// If the file cannot be read, the error is returned as is, and if it is
+// not valid YAML, the syntax error is returned alone in ConfigErrors.
+// Otherwise every problem with its contents, such as unknown keys, a
+// host name used twice or a docRoot that does not exist, is returned in
+// ConfigErrors.
+func ParseVHConfigFile(vhConfigFilePath string, docroot_dirs_path string) (map[string]*VirtualHost, error) {
+	vh_map := make(map[string]*VirtualHost)
+	vhostConfigs, lines, errs, err := readVHConfigFile(vhConfigFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range vhostConfigs.VirtualHosts {
+		vhost := &vhostConfigs.VirtualHosts[i]
+		fail := func(format string, args ...any) {
+			configErr := &ConfigError{Path: vhConfigFilePath, Err: fmt.Errorf(format, args...)}
+			if lines != nil {
+				configErr.Line = lines[i]
+			}
+			errs = append(errs, configErr)
+		}
+		if vhost.HostName == "" {
+			fail("virtual host without a hostName")
+			continue
+		}
+		if vhost.DocRoot == "" {
+			fail("host %s: missing docRoot", vhost.HostName)
+			continue
+		}
+		vhost.DocRoot = filepath.Join(docroot_dirs_path, vhost.DocRoot)
+		vhost.HostSettings = vhost.HostSettings.withDefaults(vhostConfigs.Defaults)
+
+		// Check if the path exists; for a docRoot with "${1}" in it, only
+		// the directory the captures go into can be checked
+		check_path := vhost.DocRoot
+		templated := strings.IndexByte(vhost.DocRoot, '$')
+		if templated >= 0 {
+			check_path = filepath.Dir(vhost.DocRoot[:templated])
+		}
+		if fi, err := os.Stat(check_path); err != nil {
+			fail("host %s: path to docroot %s doesn't exist : %v", vhost.HostName, vhost.DocRoot, err)
+		} else if templated < 0 && !fi.IsDir() {
+			fail("host %s: docroot %s is not a directory", vhost.HostName, vhost.DocRoot)
+		}
+		for _, name := range hostNames(vhost.HostName, vhost.Aliases) {
+			if err := checkHostName(name); err != nil {
+				fail("host %s: %v", vhost.HostName, err)
+				continue
+			}
+			key := normalizeHostName(name)
+			if other, ok := vh_map[key]; ok {
+				fail("host %s: name %s is already used by host %s", vhost.HostName, name, other.HostName)
+				continue
+			}
+			vh_map[key] = vhost
+		}
+		if vhost.CanonicalHost != "" {
+			host, err := parseHost(vhost.CanonicalHost)
+			if err != nil {
+				fail("host %s: invalid canonical host %s : %v", vhost.HostName, vhost.CanonicalHost, err)
+			}
+			vhost.CanonicalHost = host
+		}
+		for code := range vhost.ErrorPages {
+			if code < 400 || code > 599 {
+				fail("host %s: error page for %d, which is not an error status", vhost.HostName, code)
+			}
+		}
+		for _, rule := range vhost.CacheRules {
+			if _, err := path.Match(rule.Match, ""); err != nil {
+				fail("host %s: invalid cache rule pattern %q", vhost.HostName, rule.Match)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return vh_map, nil
+}
+
+// checkHostName reports whether name, from the config file, can match a
+// Host header: a host name or IP address without a port, a wildcard such
+// as "*.preview.local", or a regular expression marked by a leading "~".
+func checkHostName(name string) error {
+	if strings.HasPrefix(name, "~") {
+		_, err := hostPattern(name[1:])
+		return err
+	}
+	host := strings.TrimPrefix(name, "*.")
+	if parsed, err := parseHost(host); err != nil || parsed != strings.ToLower(host) {
+		return fmt.Errorf("invalid host name %q", name)
+	}
+	return nil
+}
+
+// normalizeHostName lowercases a host name from the config file, since
+// Host headers are matched case-insensitively. Regular expressions are
+// left alone; they are matched against lowercase hosts.
+func normalizeHostName(name string) string {
+	if strings.HasPrefix(name, "~") {
+		return name
+	}
+	return strings.ToLower(name)
+}
+
+// virtualHost returns the host that serves requests for host, which is
+// host itself if it matches a name in VirtualHosts, and DefaultHost
+// otherwise. It reports false if there is no such host. A server
+// without VirtualHosts leaves routing to its Handler.
+func (s *Server) virtualHost(host string) (string, bool) {
+	if len(s.VirtualHosts) == 0 {
+		return host, true
+	}
+	if _, ok := resolveVirtualHost(s.VirtualHosts, host); ok {
+		return host, true
+	}
+	return s.DefaultHost, s.DefaultHost != ""
+}
+
+// canonicalLocation returns the URL that req should be redirected to if
+// it names its virtual host other than by its canonical name, keeping
+// the port, path and query of the request.
+func canonicalLocation(req *Request, vh hostMatch) (string, bool) {
+	if vh.host == nil || !strings.HasPrefix(req.Path, "/") {
+		return "", false // OPTIONS * and CONNECT have no URL to redirect
+	}
+	canonical := vh.host.CanonicalHost
+	if canonical == "" || canonical == req.Host {
+		return "", false
+	}
+	hostport := req.targetHost
+	if hostport == "" {
+		hostport = req.Headers.Get("Host")
+	}
+	location := "http://" + canonical + portOf(hostport) + (&url.URL{Path: req.Path}).EscapedPath()
+	if req.RawQuery != "" {
+		location += "?" + req.RawQuery
+	}
+	return location, true
+}
+
+// portOf returns the ":port" suffix of a host, or "" if it has none.
+func portOf(hostport string) string {
+	i := strings.LastIndexByte(hostport, ':')
+	if i < 0 || i < strings.LastIndexByte(hostport, ']') || !isDigits(hostport[i+1:]) {
+		return ""
+	}
+	return hostport[i:]
+}
+
+// A hostMatch is the virtual host that serves a request.
+type hostMatch struct {
+	name    string // the name in VirtualHosts that matched
+	host    *VirtualHost
+	docRoot string // host.DocRoot with any captures expanded
+}
+
+// primaryName returns the name of the virtual host that matched, rather
+// than the alias the request may have used.
+func (vh hostMatch) primaryName() string {
+	if vh.host == nil || vh.host.HostName == "" {
+		return vh.name
+	}
+	return normalizeHostName(vh.host.HostName)
+}
+
+// resolveVirtualHost finds the name in vhosts that host matches, and
+// returns it with its virtual host and docRoot. Names are tried in this
+// order:
+//
+//   - the exact host, e.g. "website1";
+//   - wildcards, e.g. "*.preview.local" for "pr-123.preview.local" or
+//     "a.pr-123.preview.local" but not "preview.local"; the longest
+//     matching one wins;
+//   - regular expressions, marked by a leading "~", e.g.
+//     `~^pr-(\d+)\.preview\.local$`; if several match, the first in
+//     lexical order wins. "${1}" and so on in their docRoot are replaced
+//     by the groups the expression captured from the host.
+func resolveVirtualHost(vhosts map[string]*VirtualHost, host string) (hostMatch, bool) {
+	if vh, ok := vhosts[host]; ok {
+		return hostMatch{host, vh, vh.DocRoot}, true
+	}
 
-	for _, vhost := range vhostConfigs.VirtualHosts {
-		docroot_path := filepath.Join(docroot_dirs_path, vhost.DocRoot)
+	var name string
+	var regexNames []string
+	for candidate := range vhosts {
+		switch {
+		case strings.HasPrefix(candidate, "*."):
+			if strings.HasSuffix(host, candidate[1:]) && len(host) > len(candidate)-1 && len(candidate) > len(name) {
+				name = candidate
+			}
+		case strings.HasPrefix(candidate, "~"):
+			regexNames = append(regexNames, candidate)
+		}
+	}
+	if name != "" {
+		return hostMatch{name, vhosts[name], vhosts[name].DocRoot}, true
+	}
 
-		// Check if the path exists
-		_, err := os.Stat(docroot_path)
+	sort.Strings(regexNames)
+	for _, candidate := range regexNames {
+		re, err := hostPattern(candidate[1:])
 		if err != nil {
-			log.Fatalf("path to docroot %s doesn't exist : %v", docroot_path, err)
+			continue
+		}
+		match := re.FindStringSubmatchIndex(host)
+		if match == nil {
+			continue
+		}
+		if docRoot, ok := expandDocRoot(re, vhosts[candidate].DocRoot, host, match); ok {
+			return hostMatch{candidate, vhosts[candidate], docRoot}, true
+		}
+	}
+	return hostMatch{}, false
+}
+
+// expandDocRoot replaces the captures in a docRoot template. It fails if
+// a capture that is used could name another directory, such as "..".
+func expandDocRoot(re *regexp.Regexp, template, host string, match []int) (string, bool) {
+	// Group 0 is the whole match, which "${0}" can use too
+	for i := 0; i < len(match); i += 2 {
+		if match[i] < 0 {
+			continue
+		}
+		capture := host[match[i]:match[i+1]]
+		if capture == "" || capture == "." || capture == ".." || strings.ContainsAny(capture, `/\`) {
+			return "", false
 		}
-		vh_map[vhost.HostName] = docroot_path
 	}
+	return string(re.ExpandString(nil, template, host, match)), true
+}
+
+// hostPatterns caches the compiled regular expressions of host names.
+var hostPatterns sync.Map // map[string]*regexp.Regexp
 
-	return vh_map
+func hostPattern(expr string) (*regexp.Regexp, error) {
+	if re, ok := hostPatterns.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host name pattern %q: %v", expr, err)
+	}
+	hostPatterns.Store(expr, re)
+	return re, nil
 }
@@ -0,0 +1,208 @@
+package tritonhttp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveVirtualHost(t *testing.T) {
+	vhosts := map[string]*VirtualHost{
+		"website1":                         {DocRoot: "htdocs1"},
+		"*.preview.local":                  {DocRoot: "previews/any"},
+		"*.eu.preview.local":               {DocRoot: "previews/eu"},
+		`~^pr-(\d+)\.preview\.local$`:      {DocRoot: "previews/${1}"},
+		`~^(?P<app>[a-z.]+)\.apps\.local$`: {DocRoot: "apps/${app}"},
+		`~^b\.apps\.local$`:                {DocRoot: "apps/b-first"},
+		`~^[.]+$`:                          {DocRoot: "dots/${0}"},
+	}
+	tests := []struct {
+		host    string
+		name    string
+		docRoot string
+	}{
+		{"website1", "website1", "htdocs1"},
+		{"pr-123.preview.local", "*.preview.local", "previews/any"}, // wildcards beat regexes
+		{"x.eu.preview.local", "*.eu.preview.local", "previews/eu"},
+		{"eu.preview.local", "*.preview.local", "previews/any"},
+		{"shop.apps.local", `~^(?P<app>[a-z.]+)\.apps\.local$`, "apps/shop"},
+		{"b.apps.local", `~^(?P<app>[a-z.]+)\.apps\.local$`, "apps/b"}, // lexical order
+		{"...apps.local", "", ""},                                      // ".." cannot be captured
+		{"..", "", ""},                                                 // nor matched as a whole
+		{"preview.local", "", ""},
+		{"website2", "", ""},
+	}
+	for _, tt := range tests {
+		vh, ok := resolveVirtualHost(vhosts, tt.host)
+		if ok != (tt.name != "") || vh.name != tt.name || vh.docRoot != tt.docRoot || (ok && vh.host != vhosts[tt.name]) {
+			t.Errorf("resolveVirtualHost(%q) = %q, %q, %v; want %q, %q", tt.host, vh.name, vh.docRoot, ok, tt.name, tt.docRoot)
+		}
+	}
+
+	// Without a wildcard, the regex captures are used
+	delete(vhosts, "*.preview.local")
+	if vh, _ := resolveVirtualHost(vhosts, "pr-123.preview.local"); vh.docRoot != "previews/123" {
+		t.Errorf("Expected previews/123 but got %q", vh.docRoot)
+	}
+}
+
+func TestParseVHConfigFileSettings(t *testing.T) {
+	docroots := t.TempDir()
+	for _, dir := range []string{"one", "two"} {
+		if err := os.Mkdir(filepath.Join(docroots, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := filepath.Join(t.TempDir(), "virtual_hosts.yaml")
+	err := os.WriteFile(config, []byte(`defaults:
+  indexFiles: ["index.html", "index.htm"]
+  directoryListing: true
+  headers: {X-Frame-Options: DENY, X-Served-By: tritonhttp}
+  cacheRules: [{match: "*.css", cacheControl: "max-age=3600"}]
+  readTimeout: 10s
+  maxBodyBytes: 1024
+virtual_hosts:
+  - hostName: "Website1"
+    aliases: ["www.website1"]
+    canonicalHost: "WEBSITE1:8080"
+    docRoot: "one"
+    directoryListing: false
+    headers: {X-Served-By: one}
+    cacheRules: [{match: "/static/*", cacheControl: "no-cache"}]
+    errorPages: {404: "/errors/404.html"}
+    writeTimeout: 1m
+  - hostName: "website2"
+    docRoot: "two"
+    maxBodyBytes: 2048
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vhosts, err := ParseVHConfigFile(config, docroots)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	one, two := vhosts["website1"], vhosts["website2"]
+	if one == nil || two == nil || vhosts["www.website1"] != one {
+		t.Fatalf("Expected website1 with its alias and website2, got %v", vhosts)
+	}
+	if one.DocRoot != filepath.Join(docroots, "one") || one.CanonicalHost != "website1" {
+		t.Errorf("Got docRoot %q and canonical host %q", one.DocRoot, one.CanonicalHost)
+	}
+	if *one.DirectoryListing || !*two.DirectoryListing {
+		t.Errorf("Expected directory listing off for website1 and on for website2")
+	}
+	wantHeaders := map[string]string{"X-Frame-Options": "DENY", "X-Served-By": "one"}
+	if !reflect.DeepEqual(one.Headers, wantHeaders) || two.Headers["X-Served-By"] != "tritonhttp" {
+		t.Errorf("Got headers %v and %v", one.Headers, two.Headers)
+	}
+	wantRules := []CacheRule{{"/static/*", "no-cache"}, {"*.css", "max-age=3600"}}
+	if !reflect.DeepEqual(one.CacheRules, wantRules) {
+		t.Errorf("Got cache rules %v, want %v", one.CacheRules, wantRules)
+	}
+	if one.ErrorPages[404] != "/errors/404.html" || len(two.ErrorPages) != 0 {
+		t.Errorf("Got error pages %v and %v", one.ErrorPages, two.ErrorPages)
+	}
+	if one.ReadTimeout != 10*time.Second || one.WriteTimeout != time.Minute || two.WriteTimeout != 0 {
+		t.Errorf("Got timeouts %v/%v and %v/%v", one.ReadTimeout, one.WriteTimeout, two.ReadTimeout, two.WriteTimeout)
+	}
+	if one.MaxBodyBytes != 1024 || two.MaxBodyBytes != 2048 {
+		t.Errorf("Got body limits %v and %v", one.MaxBodyBytes, two.MaxBodyBytes)
+	}
+	if !reflect.DeepEqual(two.IndexFiles, []string{"index.html", "index.htm"}) {
+		t.Errorf("Got index files %v", two.IndexFiles)
+	}
+}
+
+func TestParseVHConfigFileErrors(t *testing.T) {
+	docroots := t.TempDir()
+	if err := os.Mkdir(filepath.Join(docroots, "one"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		config string
+		lines  []int    // the line of each error
+		msgs   []string // a part of each error
+	}{
+		{"unknown key", `virtual_hosts:
+  - hostName: "website1"
+    docroot: "one"
+`, []int{3, 2}, []string{"field docroot not found", "host website1: missing docRoot"}},
+		{"unknown key and duplicate host", `virtual_hosts:
+  - hostName: "website1"
+    docRoot: "one"
+    writeable: true
+
+  - hostName: "website1"
+    docRoot: "one"
+`, []int{4, 6}, []string{"field writeable not found", "name website1 is already used by host website1"}},
+		{"syntax error", `virtual_hosts:
+  - hostName: "website1"
+   docRoot: "one"
+`, []int{2}, []string{"did not find expected '-' indicator"}},
+		{"duplicate host", `virtual_hosts:
+  - hostName: "website1"
+    docRoot: "one"
+
+  - hostName: "website2"
+    aliases: ["WEBSITE1"]
+    docRoot: "one"
+`, []int{5}, []string{"name WEBSITE1 is already used by host website1"}},
+		{"several problems", `defaults:
+  errorPages: {200: "/ok.html"}
+virtual_hosts:
+  - hostName: "website1:8080"
+    docRoot: "missing"
+  - docRoot: "one"
+`, []int{4, 4, 4, 6}, []string{"path to docroot", `invalid host name "website1:8080"`, "not an error status", "without a hostName"}},
+		{"missing hostName", `virtual_hosts:
+  # the first entry
+  - hostName: "website1"
+    aliases:
+      - "www.website1"
+    docRoot: "one"
+  -
+    docRoot: "one"
+`, []int{7}, []string{"without a hostName"}},
+		{"flow style", `virtual_hosts:
+- {hostName: "website1", docRoot: "one"}
+- {hostName: "website2", docRoot: "one",
+   aliases: ["website1"]}
+defaults: {indexFiles: ["index.htm"]}
+`, []int{3}, []string{"name website1 is already used by host website1"}},
+		{"bad pattern", `virtual_hosts:
+  - hostName: "~(unclosed"
+    docRoot: "one"
+    cacheRules: [{match: "[", cacheControl: "no-cache"}]
+`, []int{2, 2}, []string{"invalid host name pattern", "invalid cache rule pattern"}},
+	}
+	for _, tt := range tests {
+		config := filepath.Join(t.TempDir(), "virtual_hosts.yaml")
+		if err := os.WriteFile(config, []byte(tt.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		vhosts, err := ParseVHConfigFile(config, docroots)
+		var errs ConfigErrors
+		if !errors.As(err, &errs) || vhosts != nil {
+			t.Fatalf("%s: expected ConfigErrors but got %v", tt.name, err)
+		}
+		if len(errs) != len(tt.msgs) {
+			t.Fatalf("%s: expected %d errors but got:\n%v", tt.name, len(tt.msgs), err)
+		}
+		for i, e := range errs {
+			if e.Path != config || e.Line != tt.lines[i] || !strings.Contains(e.Error(), tt.msgs[i]) {
+				t.Errorf("%s: expected %q on line %v but got %q", tt.name, tt.msgs[i], tt.lines, e)
+			}
+		}
+	}
+
+	if _, err := ParseVHConfigFile(filepath.Join(docroots, "missing.yaml"), docroots); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a missing config file to be reported, got %v", err)
+	}
+}
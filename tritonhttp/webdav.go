@@ -0,0 +1,466 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// readOnlyMethods are the methods a FileHandler supports on every
+// virtual host, and writableMethods the ones it adds on writable hosts.
+var (
+	readOnlyMethods = []string{"GET", "HEAD", "OPTIONS"}
+	writableMethods = []string{"PUT", "DELETE", "MKCOL", "COPY", "MOVE", "PROPFIND"}
+)
+
+// serveWebDAV handles the WebDAV methods on a writable docRoot. It reports
+// false if req.Method is not one of them. The names of the host in
+// vhosts may be used in the Destination of a COPY or MOVE.
+func (res *Response) serveWebDAV(docRoot string, req *Request, opts *FileOptions, vhosts map[string]*VirtualHost) bool {
+	switch req.Method {
+	case "PUT":
+		res.HandlePut(docRoot, req, opts)
+	case "DELETE":
+		res.HandleDelete(docRoot, req)
+	case "MKCOL":
+		res.HandleMkcol(docRoot, req)
+	case "COPY":
+		res.handleCopyMove(docRoot, req, false, vhosts)
+	case "MOVE":
+		res.handleCopyMove(docRoot, req, true, vhosts)
+	case "PROPFIND":
+		res.HandlePropfind(docRoot, req)
+	default:
+		return false
+	}
+	return true
+}
+
+// HandlePut stores the request body as the file named by req. The body is
+// written to a temporary file next to the target which is then renamed
+// over it, so that readers never see a partially written file.
+func (res *Response) HandlePut(docRoot string, req *Request, opts *FileOptions) {
+	target, ok := resolvePath(docRoot, req.Path)
+	if !ok || strings.HasSuffix(req.Path, "/") {
+		res.HandleStatusNotFound()
+		return
+	}
+	stats, err := os.Stat(target)
+	exists := err == nil
+	if exists && stats.IsDir() {
+		res.HandleMethodNotAllowed(collectionMethods()...)
+		return
+	}
+	if exists {
+		if res.checkPreconditions(req, fileETag(target, stats, opts), stats.ModTime()) {
+			return
+		}
+	} else if req.Headers.Has("If-Match") {
+		res.HandlePreconditionFailed()
+		return
+	}
+	if parent, err := os.Stat(filepath.Dir(target)); err != nil || !parent.IsDir() {
+		res.HandleConflict()
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".put-*")
+	if err != nil {
+		res.HandleInternalServerError()
+		return
+	}
+	defer os.Remove(tmp.Name()) // a no-op once it has been renamed
+	if _, err := io.Copy(tmp, req.Body); err != nil {
+		tmp.Close()
+		res.HandleBadRequest() // replaced by a 413 if the body was too large
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		res.HandleInternalServerError()
+		return
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		res.HandleInternalServerError()
+		return
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		res.HandleInternalServerError()
+		return
+	}
+	if exists {
+		res.HandleStatus(204)
+	} else {
+		res.HandleCreated()
+	}
+}
+
+// HandleDelete removes the file or directory named by req.
+func (res *Response) HandleDelete(docRoot string, req *Request) {
+	target, ok := resolvePath(docRoot, req.Path)
+	if !ok {
+		res.HandleStatusNotFound()
+		return
+	}
+	if target == filepath.Clean(docRoot) {
+		res.HandleForbidden()
+		return
+	}
+	if _, err := os.Lstat(target); err != nil {
+		res.HandleStatusNotFound()
+		return
+	}
+	if err := os.RemoveAll(target); err != nil {
+		res.HandleInternalServerError()
+		return
+	}
+	res.HandleStatus(204)
+}
+
+// HandleMkcol creates the directory named by req. Its parent must exist.
+func (res *Response) HandleMkcol(docRoot string, req *Request) {
+	target, ok := resolvePath(docRoot, req.Path)
+	if !ok {
+		res.HandleStatusNotFound()
+		return
+	}
+	if req.ContentLength != 0 {
+		res.HandleStatus(415) // MKCOL request bodies are not supported
+		return
+	}
+	if _, err := os.Lstat(target); err == nil {
+		res.HandleMethodNotAllowed(collectionMethods()...)
+		return
+	}
+	if err := os.Mkdir(target, 0755); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			res.HandleConflict()
+		} else {
+			res.HandleInternalServerError()
+		}
+		return
+	}
+	res.HandleCreated()
+}
+
+// HandleCopyMove copies, or moves, the file or directory named by req to
+// the one named by its Destination header, which must be on the same
+// virtual host. An Overwrite: F header forbids replacing an existing
+// destination. Without the virtual hosts a FileHandler has, aliases of
+// the host are not recognised as the same host.
+func (res *Response) HandleCopyMove(docRoot string, req *Request, move bool) {
+	res.handleCopyMove(docRoot, req, move, nil)
+}
+
+func (res *Response) handleCopyMove(docRoot string, req *Request, move bool, vhosts map[string]*VirtualHost) {
+	source, ok := resolvePath(docRoot, req.Path)
+	if !ok {
+		res.HandleStatusNotFound()
+		return
+	}
+	// Encoded slashes and NULs are rejected, as in request targets
+	destination, err := url.Parse(req.Headers.Get("Destination"))
+	if err != nil || destination.Path == "" || strings.ContainsRune(destination.Path, 0) {
+		res.HandleBadRequest()
+		return
+	}
+	if escaped := strings.ToLower(destination.EscapedPath()); strings.Contains(escaped, "%2f") || strings.Contains(escaped, "%00") {
+		res.HandleBadRequest()
+		return
+	}
+	if destination.Host != "" {
+		if host, err := parseHost(destination.Host); err != nil || !sameHost(host, req, vhosts) {
+			res.HandleStatus(502) // the destination is on another server
+			return
+		}
+	}
+	target, ok := resolvePath(docRoot, destination.Path)
+	if !ok {
+		res.HandleForbidden()
+		return
+	}
+	root := filepath.Clean(docRoot)
+	if source == root || target == root || target == source ||
+		strings.HasPrefix(target, source+string(filepath.Separator)) {
+		res.HandleForbidden()
+		return
+	}
+	stats, err := os.Lstat(source)
+	if err != nil {
+		res.HandleStatusNotFound()
+		return
+	}
+	if parent, err := os.Stat(filepath.Dir(target)); err != nil || !parent.IsDir() {
+		res.HandleConflict()
+		return
+	}
+	_, err = os.Lstat(target)
+	exists := err == nil
+	if exists && strings.EqualFold(req.Headers.Get("Overwrite"), "F") {
+		res.HandlePreconditionFailed()
+		return
+	}
+
+	if move {
+		err = replaceTarget(source, target)
+	} else {
+		err = copyTo(source, target, stats, req.Headers.Get("Depth") == "0")
+	}
+	if err != nil {
+		res.HandleInternalServerError()
+		return
+	}
+	if exists {
+		res.HandleStatus(204)
+	} else {
+		res.HandleCreated()
+	}
+}
+
+// sameHost reports whether host, from a Destination header, names the
+// virtual host req is for: the host req was routed to, the host it named
+// before being routed to a default host, or another name in vhosts of
+// the same virtual host and docRoot, such as an alias.
+func sameHost(host string, req *Request, vhosts map[string]*VirtualHost) bool {
+	requested := req.targetHost
+	if requested == "" {
+		requested = req.Headers.Get("Host")
+	}
+	if requested, err := parseHost(requested); host == req.Host || (err == nil && host == requested) {
+		return true
+	}
+	dest, ok := resolveVirtualHost(vhosts, host)
+	own, _ := resolveVirtualHost(vhosts, req.Host)
+	return ok && dest.host == own.host && dest.docRoot == own.docRoot
+}
+
+// copyTo copies source, described by stats, to target. The copy is made
+// in a temporary directory next to target and then renamed into place,
+// so that a failed copy leaves neither a partial copy nor a missing
+// target behind.
+func copyTo(source, target string, stats fs.FileInfo, shallow bool) error {
+	tmpDir, err := os.MkdirTemp(filepath.Dir(target), ".copy-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir) // empty once the copy has been renamed
+	staged := filepath.Join(tmpDir, filepath.Base(target))
+	if stats.IsDir() {
+		err = copyDir(source, staged, shallow)
+	} else {
+		err = copyRegularFile(source, staged, stats.Mode().Perm())
+	}
+	if err != nil {
+		return err
+	}
+	return replaceTarget(staged, target)
+}
+
+// replaceTarget renames staged to target, replacing any existing target.
+// A file is renamed over a file, which replaces it atomically. Otherwise
+// the existing target is first moved aside, put back if staged cannot
+// take its place, and only removed once it has.
+func replaceTarget(staged, target string) error {
+	old, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return os.Rename(staged, target)
+	}
+	if err != nil {
+		return err
+	}
+	stagedStats, err := os.Lstat(staged)
+	if err != nil {
+		return err
+	}
+	if !old.IsDir() && !stagedStats.IsDir() {
+		return os.Rename(staged, target)
+	}
+
+	asideDir, err := os.MkdirTemp(filepath.Dir(target), ".old-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(asideDir)
+	aside := filepath.Join(asideDir, filepath.Base(target))
+	if err := os.Rename(target, aside); err != nil {
+		return err
+	}
+	if err := os.Rename(staged, target); err != nil {
+		_ = os.Rename(aside, target)
+		return err
+	}
+	return nil
+}
+
+// copyDir copies the directory source to target, including everything
+// below it unless shallow is set.
+func copyDir(source, target string, shallow bool) error {
+	if shallow {
+		return os.Mkdir(target, 0755)
+	}
+	return filepath.WalkDir(source, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, p)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(target, rel)
+		if d.IsDir() {
+			return os.Mkdir(dst, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil // symlinks and devices are not copied
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return copyRegularFile(p, dst, info.Mode().Perm())
+	})
+}
+
+func copyRegularFile(source, target string, perm fs.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// multistatus is the XML body of a 207 PROPFIND response.
+type multistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string `xml:"D:href"`
+	Propstat struct {
+		Prop   davProp `xml:"D:prop"`
+		Status string  `xml:"D:status"`
+	} `xml:"D:propstat"`
+}
+
+type davProp struct {
+	DisplayName  string `xml:"D:displayname"`
+	ResourceType struct {
+		Collection *struct{} `xml:"D:collection,omitempty"`
+	} `xml:"D:resourcetype"`
+	GetContentLength string `xml:"D:getcontentlength,omitempty"`
+	GetContentType   string `xml:"D:getcontenttype,omitempty"`
+	GetLastModified  string `xml:"D:getlastmodified"`
+}
+
+// HandlePropfind lists the properties of the file or directory named by
+// req, and with "Depth: 1" those of the directory's members too. The
+// properties requested in the body are ignored; all of them are sent.
+func (res *Response) HandlePropfind(docRoot string, req *Request) {
+	target, ok := resolvePath(docRoot, req.Path)
+	if !ok {
+		res.HandleStatusNotFound()
+		return
+	}
+	depth := req.Headers.Get("Depth")
+	if depth == "" || strings.EqualFold(depth, "infinity") {
+		res.HandleForbidden() // listing whole trees is not supported
+		return
+	}
+	if depth != "0" && depth != "1" {
+		res.HandleBadRequest()
+		return
+	}
+	stats, err := os.Stat(target)
+	if err != nil {
+		res.HandleStatusNotFound()
+		return
+	}
+
+	href := path.Clean("/" + req.Path)
+	ms := multistatus{Namespace: "DAV:"}
+	ms.Responses = append(ms.Responses, propfindResponse(href, stats))
+	if depth == "1" && stats.IsDir() {
+		entries, err := os.ReadDir(target)
+		if err != nil {
+			res.HandleInternalServerError()
+			return
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			ms.Responses = append(ms.Responses, propfindResponse(path.Join(href, entry.Name()), info))
+		}
+	}
+
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	if err := xml.NewEncoder(&body).Encode(ms); err != nil {
+		res.HandleInternalServerError()
+		return
+	}
+	res.HandleStatus(207)
+	res.Headers.Set("Content-Type", "application/xml; charset=utf-8")
+	res.Body = &body
+}
+
+func propfindResponse(href string, info fs.FileInfo) davResponse {
+	var r davResponse
+	r.Href = (&url.URL{Path: href}).EscapedPath()
+	r.Propstat.Status = "HTTP/1.1 200 OK"
+	prop := &r.Propstat.Prop
+	prop.DisplayName = info.Name()
+	prop.GetLastModified = FormatTime(info.ModTime())
+	if info.IsDir() {
+		prop.ResourceType.Collection = &struct{}{}
+		if !strings.HasSuffix(r.Href, "/") {
+			r.Href += "/"
+		}
+	} else {
+		prop.GetContentLength = strconv.FormatInt(info.Size(), 10)
+		prop.GetContentType = MIMETypeByExtension(filepath.Ext(info.Name()))
+	}
+	return r
+}
+
+// HandleOptions lists the methods allowed on a virtual host.
+func (res *Response) HandleOptions(writable bool) {
+	res.HandleStatus(200)
+	res.Headers.Set("Allow", strings.Join(allowedMethods(writable), ", "))
+	if writable {
+		res.Headers.Set("Dav", "1")
+	}
+}
+
+func allowedMethods(writable bool) []string {
+	if writable {
+		return append(append([]string{}, readOnlyMethods...), writableMethods...)
+	}
+	return readOnlyMethods
+}
+
+// collectionMethods are the methods allowed on an existing directory.
+func collectionMethods() []string {
+	return []string{"GET", "HEAD", "OPTIONS", "DELETE", "COPY", "MOVE", "PROPFIND"}
+}